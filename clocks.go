@@ -15,10 +15,18 @@
 // Package clocks enables time travel (sort of)
 //
 // The Clock interface groups all the time-passage-dependent features from the
-// standard time package.
+// standard time package. It combines the read-only Reader interface, for the
+// code that depends on time, with the Controller interface, for the code that
+// moves it. Like time.Since and time.Until, the Since and Until methods measure
+// elapsed time on a monotonic timeline where the clock has one, so the results
+// are not affected by steps of the wall time. WithDeadline and WithTimeout derive
+// contexts that expire according to a clock, rather than real time.
 //
 // A "live" Clock is provided in this package giving pass-through access to the
-// standard functionality.
+// standard functionality. An "offset" Clock is shifted from real time by an
+// adjustable offset, and a "scaled" Clock runs faster or slower than real time,
+// by an adjustable factor. Since they are built on the time package, these clocks
+// transparently follow the fake time of a testing/synctest bubble when used in one.
 //
 // A "manual" Clock is included as a separate package, because it is mostly useful
 // for testing and it is rarely if ever needed in the actual program.
@@ -28,12 +36,20 @@ import (
 	"time"
 )
 
-// Clock is the interface implemented by all clocks based on this package.
+// Clock is the interface implemented by all clocks based on this package. It
+// combines the Reader and Controller interfaces.
 type Clock interface {
-	Add(d time.Duration)
-	Set(t time.Time)
+	Reader
+	Controller
+}
 
+// Reader is the read-only interface of a clock. Code that only needs to tell the
+// time, sleep or use timers and tickers should accept a Reader rather than a
+// Clock, so it cannot move the time by accident.
+type Reader interface {
 	Now() time.Time
+	Since(t time.Time) time.Duration
+	Until(t time.Time) time.Duration
 
 	Sleep(d time.Duration)
 
@@ -45,8 +61,32 @@ type Clock interface {
 	NewTicker(d time.Duration) Ticker
 }
 
+// Controller is the interface for moving a clock. Add and Set are no-ops on live
+// clocks that cannot be moved.
+type Controller interface {
+	Add(d time.Duration)
+	Set(t time.Time)
+}
+
+// ReadOnly returns a Reader that exposes only the read-only interface of c, so
+// that its Controller methods cannot be reached with a type assertion.
+func ReadOnly(c Reader) Reader {
+	return readOnly{c}
+}
+
+// readOnly hides all the methods of a clock except those of the Reader interface.
+type readOnly struct {
+	Reader
+}
+
 // Timer is a common interface for event timers. It is conceptually identical to
 // time.Timer, except the channel is accessible via a method, rather than directly.
+//
+// Timers follow the channel semantics of time.Timer as of Go 1.23: once Stop or
+// Reset returns, no value sent before the call is received from the channel, and
+// both report true if such a value was sent but not received yet. The live clock
+// inherits the actual behavior of the time package, which depends on the Go version
+// and on the asynctimerchan GODEBUG setting.
 type Timer interface {
 	C() <-chan time.Time
 	Stop() bool
@@ -55,9 +95,11 @@ type Timer interface {
 
 // Ticker is a common interface for "tickers". It is conceptually identical to
 // time.Ticker, except the channel is accessible via a method, rather than directly.
+// As for Timer, no tick sent before Stop or Reset is received after they return.
 type Ticker interface {
 	C() <-chan time.Time
 	Stop()
+	Reset(time.Duration)
 }
 
 // New returns a live Clock instance.
@@ -77,6 +119,12 @@ func (*liveClock) Set(t time.Time) {}
 // Now is a pass-through wrapper around time.Now
 func (*liveClock) Now() time.Time { return time.Now() }
 
+// Since is a pass-through wrapper around time.Since
+func (*liveClock) Since(t time.Time) time.Duration { return time.Since(t) }
+
+// Until is a pass-through wrapper around time.Until
+func (*liveClock) Until(t time.Time) time.Duration { return time.Until(t) }
+
 // Sleep is a pass-through wrapper around time.Sleep
 func (*liveClock) Sleep(d time.Duration) { time.Sleep(d) }
 
@@ -78,6 +78,17 @@ func Test_New(t *testing.T) {
 			}()
 			return ch
 		}(),
+		"TickerReset": func() <-chan time.Time {
+			ch := make(chan time.Time, 1)
+			go func() {
+				nt := clock.NewTicker(time.Hour)
+				nt.Reset(50 * time.Millisecond)
+				<-nt.C()
+				ch <- clock.Now()
+				nt.Stop()
+			}()
+			return ch
+		}(),
 	}
 
 	for fn := range timeout {
@@ -88,3 +99,13 @@ func Test_New(t *testing.T) {
 		}
 	}
 }
+
+func Test_ReadOnly(t *testing.T) {
+	var r Reader = ReadOnly(New())
+	if _, ok := r.(Controller); ok {
+		t.Error(`ReadOnly() should hide the Controller methods`)
+	}
+	if time.Since(r.Now()) > time.Second {
+		t.Error(`ReadOnly().Now() is too far from time.Now()`)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clockstest binds a manual clock to a test, with assertions on its timers,
+// tickers and sleeps. On failure, the test is reported along with a readable dump
+// of the events pending on the clock.
+package clockstest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agext/clocks/manualclock"
+)
+
+// DefaultTimeout is the initial Timeout of the clocks returned by New.
+const DefaultTimeout = time.Second
+
+// Clock is a manual clock bound to a test.
+type Clock struct {
+	manualclock.Clock
+
+	// Timeout is how long, in real time, ExpectTimer waits for the expected
+	// event to be created by the code under test.
+	Timeout time.Duration
+
+	tb testing.TB
+}
+
+// New returns a manual clock bound to tb, configured by the provided options. When
+// the test and its subtests complete, the test fails if any timer, ticker or sleep
+// is still pending on the clock.
+func New(tb testing.TB, opts ...manualclock.Option) *Clock {
+	c := &Clock{
+		Clock:   manualclock.New(opts...),
+		Timeout: DefaultTimeout,
+		tb:      tb,
+	}
+	tb.Cleanup(c.AssertNoPendingEvents)
+	return c
+}
+
+// Dump returns a description of the events pending on the clock, one per line,
+// with their times relative to the current time.
+func (c *Clock) Dump() string {
+	now := c.Now()
+	var b strings.Builder
+	for _, e := range c.Pending() {
+		if e.Stopped {
+			continue
+		}
+		b.WriteString("\n\tin " + e.Next.Sub(now).String() + ": " + e.String())
+	}
+	if b.Len() == 0 {
+		return "\n\tno pending events"
+	}
+	return b.String()
+}
+
+// ExpectTimer waits for a timer, ticker or sleep to be pending on the clock and
+// due in d, and returns it. If none is created within c.Timeout, the test fails.
+func (c *Clock) ExpectTimer(d time.Duration) manualclock.Event {
+	c.tb.Helper()
+	timeout := time.NewTimer(c.Timeout)
+	defer timeout.Stop()
+	for {
+		changed := c.Changed()
+		next := c.Now().Add(d)
+		for _, e := range c.Pending() {
+			if !e.Stopped && e.Next.Equal(next) {
+				return e
+			}
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			c.tb.Errorf(`no event pending in %s; pending events:%s`, d, c.Dump())
+			return manualclock.Event{}
+		}
+	}
+}
+
+// AdvanceAndExpectFire moves the clock forward by d, and returns the value then
+// received from ch. The test fails if ch delivers a value before the clock moves,
+// or none after.
+func (c *Clock) AdvanceAndExpectFire(d time.Duration, ch <-chan time.Time) time.Time {
+	c.tb.Helper()
+	select {
+	case t := <-ch:
+		c.tb.Errorf(`channel fired at %s, before the clock moved by %s`, t, d)
+		return t
+	default:
+	}
+	c.Add(d)
+	select {
+	case t := <-ch:
+		return t
+	default:
+		c.tb.Errorf(`channel did not fire when the clock moved by %s; pending events:%s`, d, c.Dump())
+		return time.Time{}
+	}
+}
+
+// AssertNoPendingEvents fails the test if any timer, ticker or sleep is pending
+// on the clock. It is called automatically at the end of the test.
+func (c *Clock) AssertNoPendingEvents() {
+	c.tb.Helper()
+	for _, e := range c.Pending() {
+		if !e.Stopped {
+			c.tb.Errorf(`unexpected pending events:%s`, c.Dump())
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clockstest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recorder is a testing.TB that records errors instead of failing the test.
+type recorder struct {
+	testing.TB
+	errors   []string
+	cleanups []func()
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Cleanup(f func()) {
+	r.cleanups = append(r.cleanups, f)
+}
+
+func Test_Clock(t *testing.T) {
+	clock := New(t)
+
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(time.Minute)
+		close(done)
+	}()
+	clock.ExpectTimer(time.Minute)
+	clock.Add(time.Minute)
+	<-done
+
+	timer := clock.NewTimer(time.Second)
+	if rt, exp := clock.AdvanceAndExpectFire(time.Second, timer.C()), clock.Now(); !rt.Equal(exp) {
+		t.Errorf(`unexpected fire time: want %s got %s`, exp, rt)
+	}
+}
+
+func Test_Failures(t *testing.T) {
+	r := &recorder{TB: t}
+	clock := New(r)
+	ticker := clock.NewTicker(time.Hour)
+	ticker.(interface{ SetLabel(string) }).SetLabel("poll")
+
+	clock.Timeout = 10 * time.Millisecond
+	clock.ExpectTimer(time.Minute)
+	clock.AdvanceAndExpectFire(time.Minute, ticker.C())
+	for _, f := range r.cleanups {
+		f()
+	}
+
+	if len(r.errors) != 3 {
+		t.Fatalf(`unexpected number of failures: want %d got %d: %q`, 3, len(r.errors), r.errors)
+	}
+	for i, exp := range []string{`no event pending in 1m0s`, `did not fire`, `unexpected pending events`} {
+		if !strings.Contains(r.errors[i], exp) {
+			t.Errorf(`failure %d should contain %q: got %q`, i, exp, r.errors[i])
+		}
+		if !strings.Contains(r.errors[i], `ticker "poll"`) {
+			t.Errorf(`failure %d should include a dump of pending events: got %q`, i, r.errors[i])
+		}
+	}
+	if !strings.Contains(r.errors[0], `in 1h0m0s: ticker "poll"`) {
+		t.Errorf(`dump should show the time until each event: got %q`, r.errors[0])
+	}
+	ticker.Stop()
+}
@@ -0,0 +1,278 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conformance checks that an implementation of clocks.Clock behaves like
+// the clocks provided by this module, e.g. a wrapper around one of them.
+//
+// Run takes a function returning a new clock and a function that moves it forward,
+// so the same checks apply to live clocks, which only need some real time to pass,
+// and to controllable ones, such as manual clocks.
+package conformance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/agext/clocks"
+)
+
+// Unit is the base duration of the checks. Their durations are small multiples
+// of Unit, so a live clock completes all the checks in about a second.
+const Unit = 50 * time.Millisecond
+
+// Run runs the conformance checks as subtests of t. newClock returns a new clock
+// for each check. advance moves the clock forward by d, and returns once the events
+// due in the meantime have been delivered: for a manual clock it is c.Add(d), while
+// for a live clock it is sleeping for a bit longer than d, e.g. d + Unit/5.
+func Run(t *testing.T, newClock func() clocks.Clock, advance func(c clocks.Clock, d time.Duration)) {
+	for _, check := range []struct {
+		name string
+		fn   func(t *testing.T, c clocks.Clock, advance func(d time.Duration))
+	}{
+		{"Now", checkNow},
+		{"TimerStop", checkTimerStop},
+		{"TimerReset", checkTimerReset},
+		{"TimerStaleValue", checkTimerStaleValue},
+		{"TickerDrop", checkTickerDrop},
+		{"TickerReset", checkTickerReset},
+		{"AfterFunc", checkAfterFunc},
+		{"NonPositive", checkNonPositive},
+		{"TickerPanics", checkTickerPanics},
+	} {
+		check := check
+		t.Run(check.name, func(t *testing.T) {
+			c := newClock()
+			check.fn(t, c, func(d time.Duration) { advance(c, d) })
+		})
+	}
+}
+
+// fired reports whether a value can be received from c without blocking.
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// returns reports whether f returns within a second of real time.
+func returns(f func()) bool {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func checkNow(t *testing.T, c clocks.Clock, advance func(time.Duration)) {
+	start := c.Now()
+	advance(Unit)
+	if d := c.Now().Sub(start); d < Unit {
+		t.Errorf(`Now() moved by %s, want at least %s`, d, Unit)
+	}
+	if d := c.Since(start); d < Unit {
+		t.Errorf(`Since() is %s, want at least %s`, d, Unit)
+	}
+	if d := c.Until(start); d > -Unit {
+		t.Errorf(`Until() is %s, want at most %s`, d, -Unit)
+	}
+}
+
+func checkTimerStop(t *testing.T, c clocks.Clock, advance func(time.Duration)) {
+	timer := c.NewTimer(2 * Unit)
+	if !timer.Stop() {
+		t.Error(`Stop() on an active timer should return true`)
+	}
+	if timer.Stop() {
+		t.Error(`Stop() on a stopped timer should return false`)
+	}
+	advance(3 * Unit)
+	if fired(timer.C()) {
+		t.Error(`stopped timer fired`)
+	}
+}
+
+func checkTimerReset(t *testing.T, c clocks.Clock, advance func(time.Duration)) {
+	timer := c.NewTimer(2 * Unit)
+	advance(Unit)
+	if !timer.Reset(2 * Unit) {
+		t.Error(`Reset() on an active timer should return true`)
+	}
+	advance(Unit)
+	if fired(timer.C()) {
+		t.Error(`timer fired at its original time after Reset()`)
+	}
+	advance(Unit)
+	if !fired(timer.C()) {
+		t.Error(`timer did not fire at its new time after Reset()`)
+	}
+	if timer.Reset(Unit) {
+		t.Error(`Reset() on an expired timer should return false`)
+	}
+	advance(2 * Unit)
+	if !fired(timer.C()) {
+		t.Error(`Reset() did not reactivate an expired timer`)
+	}
+}
+
+// checkTimerStaleValue accepts both the timer channel semantics of Go 1.23 and
+// later, where Stop and Reset discard a value that was not received, and the
+// earlier ones, as the live clock follows whichever the program selects with the
+// asynctimerchan GODEBUG setting. A clock must apply them consistently.
+func checkTimerStaleValue(t *testing.T, c clocks.Clock, advance func(time.Duration)) {
+	timer := c.NewTimer(Unit)
+	advance(2 * Unit)
+	if !timer.Reset(2 * Unit) {
+		// earlier semantics: the value stays in the channel
+		if !fired(timer.C()) {
+			t.Error(`Reset() returned false, but the value of the expired timer was lost`)
+		}
+		advance(3 * Unit)
+		if timer.Stop() {
+			t.Error(`Stop() returned true on an expired timer, after Reset() returned false on one`)
+		}
+		if !fired(timer.C()) {
+			t.Error(`Stop() returned false, but the value of the expired timer was lost`)
+		}
+		return
+	}
+	if fired(timer.C()) {
+		t.Error(`stale value received after Reset()`)
+	}
+	advance(3 * Unit)
+	if !timer.Stop() {
+		t.Error(`Stop() on a timer whose value was not received should return true`)
+	}
+	if fired(timer.C()) {
+		t.Error(`stale value received after Stop()`)
+	}
+}
+
+func checkTickerDrop(t *testing.T, c clocks.Clock, advance func(time.Duration)) {
+	ticker := c.NewTicker(2 * Unit)
+	defer ticker.Stop()
+	advance(7 * Unit)
+	if !fired(ticker.C()) {
+		t.Fatal(`ticker did not tick`)
+	}
+	if fired(ticker.C()) {
+		t.Error(`ticker should drop the ticks a slow reader misses`)
+	}
+	ticker.Stop()
+	advance(3 * Unit)
+	if fired(ticker.C()) {
+		t.Error(`stopped ticker ticked`)
+	}
+}
+
+func checkTickerReset(t *testing.T, c clocks.Clock, advance func(time.Duration)) {
+	ticker := c.NewTicker(2 * Unit)
+	defer ticker.Stop()
+	advance(Unit)
+	ticker.Reset(3 * Unit)
+	advance(Unit)
+	if fired(ticker.C()) {
+		t.Error(`ticker ticked on its old period after Reset()`)
+	}
+	advance(2 * Unit)
+	if !fired(ticker.C()) {
+		t.Error(`ticker did not tick on its new period after Reset()`)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error(`Reset() should panic on a non-positive interval`)
+		}
+	}()
+	ticker.Reset(0)
+}
+
+func checkAfterFunc(t *testing.T, c clocks.Clock, advance func(time.Duration)) {
+	release := make(chan struct{})
+	done := make(chan struct{})
+	timer := c.AfterFunc(Unit, func() {
+		<-release
+		close(done)
+	})
+	// f runs in its own goroutine, so it may block without blocking the clock
+	advance(2 * Unit)
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal(`AfterFunc() did not call its function`)
+	}
+	if timer.Stop() {
+		t.Error(`Stop() on an expired AfterFunc timer should return false`)
+	}
+
+	called := make(chan struct{}, 1)
+	timer = c.AfterFunc(Unit, func() { called <- struct{}{} })
+	if !timer.Stop() {
+		t.Error(`Stop() on an active AfterFunc timer should return true`)
+	}
+	advance(2 * Unit)
+	select {
+	case <-called:
+		t.Error(`AfterFunc() called its function after Stop()`)
+	default:
+	}
+}
+
+func checkNonPositive(t *testing.T, c clocks.Clock, advance func(time.Duration)) {
+	for _, d := range []time.Duration{0, -Unit} {
+		if !returns(func() { c.Sleep(d) }) {
+			t.Errorf(`Sleep(%s) should return immediately`, d)
+		}
+		after := c.After(d)
+		timer := c.NewTimer(d)
+		called := make(chan struct{}, 1)
+		c.AfterFunc(d, func() { called <- struct{}{} })
+		advance(0)
+		if !fired(after) {
+			t.Errorf(`After(%s) should fire without the clock moving`, d)
+		}
+		if !fired(timer.C()) {
+			t.Errorf(`NewTimer(%s) should fire without the clock moving`, d)
+		}
+		select {
+		case <-called:
+		case <-time.After(time.Second):
+			t.Errorf(`AfterFunc(%s) should call its function without the clock moving`, d)
+		}
+	}
+}
+
+func checkTickerPanics(t *testing.T, c clocks.Clock, advance func(time.Duration)) {
+	for _, d := range []time.Duration{0, -Unit} {
+		if c.Tick(d) != nil {
+			t.Errorf(`Tick(%s) should return nil`, d)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf(`NewTicker(%s) should panic`, d)
+				}
+			}()
+			c.NewTicker(d)
+		}()
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/agext/clocks"
+	"github.com/agext/clocks/manualclock"
+	"github.com/agext/clocks/replayclock"
+)
+
+// sleep advances a live clock by waiting for a bit longer than d in real time.
+func sleep(c clocks.Clock, d time.Duration) {
+	time.Sleep(d + Unit/5)
+}
+
+// add advances a controllable clock.
+func add(c clocks.Clock, d time.Duration) {
+	c.Add(d)
+}
+
+func Test_Live(t *testing.T) {
+	Run(t, clocks.New, sleep)
+}
+
+func Test_Offset(t *testing.T) {
+	Run(t, func() clocks.Clock { return clocks.NewOffset(time.Hour) }, sleep)
+}
+
+func Test_Scaled(t *testing.T) {
+	Run(t, func() clocks.Clock { return clocks.NewScaled(time.Now(), 1) }, sleep)
+}
+
+func Test_Manual(t *testing.T) {
+	Run(t, func() clocks.Clock { return manualclock.New(manualclock.WithLegacyTimerChan(false)) }, add)
+}
+
+func Test_Recorder(t *testing.T) {
+	Run(t, func() clocks.Clock { return replayclock.NewRecorder(manualclock.New(), io.Discard) }, add)
+}
+
+func Test_ManualLegacy(t *testing.T) {
+	Run(t, func() clocks.Clock { return manualclock.New(manualclock.WithLegacyTimerChan(true)) }, add)
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clocks
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithDeadline is the clock-aware counterpart of context.WithDeadline. The returned
+// context reports d as its deadline, and its Done channel is closed when the clock
+// reaches d, when the returned cancel function is called, or when the parent's
+// Done channel is closed, whichever happens first.
+//
+// Unless c is the live clock, a deadline of the parent is not taken into account
+// for the returned deadline, since it is measured on a different timeline. The
+// contexts derived from the returned one report context.DeadlineExceeded once it
+// expires, like the ones derived from a context.WithDeadline context.
+func WithDeadline(parent context.Context, c Reader, d time.Time) (context.Context, context.CancelFunc) {
+	if cur, ok := parent.Deadline(); ok && cur.Before(d) && isLive(c) {
+		// The parent deadline is already sooner than the new one.
+		return context.WithCancel(parent)
+	}
+	inner, cancel := context.WithCancelCause(parent)
+	ctx := &deadlineCtx{
+		Context:  inner,
+		cancel:   cancel,
+		deadline: d,
+		done:     make(chan struct{}),
+	}
+	if dur := d.Sub(c.Now()); dur > 0 {
+		ctx.mu.Lock()
+		ctx.timer = c.AfterFunc(dur, ctx.expire)
+		ctx.mu.Unlock()
+	} else {
+		ctx.expire()
+	}
+	// release the clock timer as soon as the context is done, for any reason
+	context.AfterFunc(inner, ctx.stop)
+	return ctx, ctx.Cancel
+}
+
+// WithTimeout is the clock-aware counterpart of context.WithTimeout.
+// It returns WithDeadline(parent, c, c.Now().Add(timeout)).
+func WithTimeout(parent context.Context, c Reader, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return WithDeadline(parent, c, c.Now().Add(timeout))
+}
+
+// isLive reports whether c is the live clock, possibly made read-only.
+func isLive(c Reader) bool {
+	if ro, ok := c.(readOnly); ok {
+		c = ro.Reader
+	}
+	_, ok := c.(*liveClock)
+	return ok
+}
+
+// deadlineCtx is a context with a deadline measured on a clock.
+//
+// Its Done channel is its own, rather than the one of the embedded context, so
+// that the context package does not link derived contexts to the embedded one,
+// whose error is context.Canceled, but watches Done and reports Err instead.
+type deadlineCtx struct {
+	context.Context                         // cancelable child of the parent context
+	cancel          context.CancelCauseFunc // cancels the embedded context
+	deadline        time.Time               // clock time when the context expires
+	done            chan struct{}           // closed when the context is done
+	timer           Timer                   // clock timer that expires the context
+	err             error                   // context.DeadlineExceeded once expired
+	mu              sync.Mutex              // protection for `timer` and `err`, and for closing `done`
+}
+
+// Deadline returns the clock time when the context expires.
+func (c *deadlineCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+// Done returns a channel that is closed when the context is done.
+func (c *deadlineCtx) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns nil until the context is done, then context.DeadlineExceeded if the
+// context expired, or the error of the embedded context otherwise.
+func (c *deadlineCtx) Err() error {
+	select {
+	case <-c.done:
+	default:
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.Context.Err()
+}
+
+func (c *deadlineCtx) String() string {
+	return "clocks.WithDeadline(" + c.deadline.String() + ")"
+}
+
+// expire cancels the context with context.DeadlineExceeded, unless already canceled.
+func (c *deadlineCtx) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Context.Err() == nil {
+		c.err = context.DeadlineExceeded
+		c.cancel(c.err)
+	}
+	c.close()
+}
+
+// Cancel cancels the context with context.Canceled, unless already done.
+func (c *deadlineCtx) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancel(context.Canceled)
+	c.close()
+}
+
+// stop is called once the embedded context is done, to release the clock timer
+// and close the Done channel if the parent was canceled.
+func (c *deadlineCtx) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.close()
+}
+
+// close releases the clock timer, and closes the Done channel, unless already
+// closed. The caller must hold the mutex.
+func (c *deadlineCtx) close() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clocks
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_WithDeadline(t *testing.T) {
+	clock := New()
+
+	d := clock.Now().Add(time.Hour)
+	ctx, cancel := WithDeadline(context.Background(), clock, d)
+	if dl, ok := ctx.Deadline(); !ok || dl != d {
+		t.Errorf(`Deadline() is incorrect: want %s got %s`, d, dl)
+	}
+	if err := ctx.Err(); err != nil {
+		t.Errorf(`unexpected error before deadline: %v`, err)
+	}
+	cancel()
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal(`cancel() did not close Done channel`)
+	}
+	if err := ctx.Err(); err != context.Canceled {
+		t.Errorf(`unexpected error after cancel: want %v got %v`, context.Canceled, err)
+	}
+
+	ctx, cancel = WithDeadline(context.Background(), clock, clock.Now().Add(-time.Second))
+	defer cancel()
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal(`a deadline in the past did not close Done channel`)
+	}
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		t.Errorf(`unexpected error after deadline: want %v got %v`, context.DeadlineExceeded, err)
+	}
+
+	parent, pcancel := context.WithTimeout(context.Background(), time.Minute)
+	defer pcancel()
+	ctx, cancel = WithDeadline(parent, clock, clock.Now().Add(time.Hour))
+	defer cancel()
+	pd, _ := parent.Deadline()
+	if d, _ := ctx.Deadline(); d != pd {
+		t.Errorf(`a sooner parent deadline is not preserved: want %s got %s`, pd, d)
+	}
+	pcancel()
+	<-ctx.Done()
+	if err := ctx.Err(); err != context.Canceled {
+		t.Errorf(`unexpected error after parent cancel: want %v got %v`, context.Canceled, err)
+	}
+}
+
+func Test_WithTimeout(t *testing.T) {
+	clock := New()
+
+	ctx, cancel := WithTimeout(context.Background(), clock, 5*time.Millisecond)
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal(`WithTimeout() is taking too long - the clock may not be live`)
+	}
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		t.Errorf(`unexpected error after timeout: want %v got %v`, context.DeadlineExceeded, err)
+	}
+	if err := context.Cause(ctx); err != context.DeadlineExceeded {
+		t.Errorf(`unexpected cause after timeout: want %v got %v`, context.DeadlineExceeded, err)
+	}
+}
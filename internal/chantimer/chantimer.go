@@ -0,0 +1,123 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chantimer provides the timers with a channel that the clocks of this
+// module build on the AfterFunc timers of another clock.
+package chantimer
+
+import (
+	"sync"
+	"time"
+)
+
+// Stopper is the part of an underlying timer that a Timer uses.
+type Stopper interface {
+	Stop() bool
+}
+
+// AfterFunc starts an underlying timer that calls f in its own goroutine after d.
+type AfterFunc func(d time.Duration, f func()) Stopper
+
+// Timer is a timer built on underlying AfterFunc timers. A new underlying timer is
+// started on each Reset, so that a late firing of the previous one can be told
+// apart and ignored.
+type Timer struct {
+	c         chan time.Time
+	afterFunc AfterFunc
+	now       func() time.Time // returns the time of a firing; called once per firing
+	fn        func()           // function called instead of sending on `c`, if not nil
+	timer     Stopper          // underlying timer for the current expiry
+	gen       int              // incremented when the underlying timer is replaced or stopped
+	mu        sync.Mutex       // protection for `timer` and `gen`, and for sending on `c`
+}
+
+// New returns a timer that fires after d, using afterFunc to start underlying
+// timers. When it fires, it calls fn if not nil, or sends the time returned by
+// now on its channel otherwise.
+func New(afterFunc AfterFunc, now func() time.Time, fn func(), d time.Duration) *Timer {
+	t := &Timer{
+		afterFunc: afterFunc,
+		now:       now,
+		fn:        fn,
+	}
+	if fn == nil {
+		t.c = make(chan time.Time, 1)
+	}
+	t.mu.Lock()
+	t.start(d)
+	t.mu.Unlock()
+	return t
+}
+
+// C returns the timer-expiry channel, which is nil if the timer calls a function.
+func (t *Timer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop turns off the timer. It returns true if the timer was active, including
+// when it fired but its value was not received yet: that value is discarded.
+func (t *Timer) Stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	active := t.timer.Stop()
+	t.gen++
+	return Drain(t.c) || active
+}
+
+// Reset changes the expiry time of the timer, and reactivates it if it was stopped.
+// As with Stop, a value that was not received yet is discarded.
+func (t *Timer) Reset(d time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	active := t.timer.Stop()
+	active = Drain(t.c) || active
+	t.start(d)
+	return active
+}
+
+// start starts a new underlying timer. The caller must hold the mutex.
+func (t *Timer) start(d time.Duration) {
+	t.gen++
+	gen := t.gen
+	t.timer = t.afterFunc(d, func() { t.fire(gen) })
+}
+
+// fire calls the timer function, or sends the time of the firing on the channel,
+// unless the underlying timer was replaced or stopped in the meantime.
+func (t *Timer) fire(gen int) {
+	now := t.now()
+	if t.fn != nil {
+		t.fn()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if gen == t.gen {
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+}
+
+// Drain discards the value sent on c but not received yet, if any, reporting
+// whether there was one.
+func Drain(c chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
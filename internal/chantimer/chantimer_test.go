@@ -0,0 +1,69 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chantimer
+
+import (
+	"testing"
+	"time"
+)
+
+// fake is an underlying timer that only fires when told to.
+type fake struct {
+	f       func()
+	stopped bool
+}
+
+func (f *fake) Stop() bool {
+	active := !f.stopped
+	f.stopped = true
+	return active
+}
+
+func Test_Timer(t *testing.T) {
+	var started []*fake
+	afterFunc := func(d time.Duration, f func()) Stopper {
+		ft := &fake{f: f}
+		started = append(started, ft)
+		return ft
+	}
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	timer := New(afterFunc, func() time.Time { return now }, nil, time.Second)
+
+	if !timer.Reset(time.Minute) {
+		t.Error(`Reset() on an active timer should return true`)
+	}
+	// late firing of the timer started before Reset
+	started[0].f()
+	select {
+	case <-timer.C():
+		t.Fatal(`late firing of a replaced timer was delivered`)
+	default:
+	}
+
+	started[1].f()
+	select {
+	case rt := <-timer.C():
+		if !rt.Equal(now) {
+			t.Errorf(`unexpected time delivered: want %s got %s`, now, rt)
+		}
+	default:
+		t.Fatal(`firing of the current timer was not delivered`)
+	}
+
+	started[1].stopped = true
+	if timer.Stop() {
+		t.Error(`Stop() on an expired timer should return false`)
+	}
+}
@@ -15,61 +15,140 @@
 package manualclock
 
 import (
-	"sync"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Kind identifies the feature an event was created by.
+type Kind int
+
+// Kinds of events.
+const (
+	KindTimer     Kind = iota // created by NewTimer or After
+	KindAfterFunc             // created by AfterFunc
+	KindSleep                 // created by Sleep
+	KindTicker                // created by NewTicker or Tick
+)
+
+var kindNames = [...]string{"timer", "AfterFunc", "sleep", "ticker"}
+
+func (k Kind) String() string {
+	if k >= 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Event is a snapshot of a timer, ticker or sleep controlled by a manual clock.
+type Event struct {
+	Kind    Kind          // the feature the event was created by
+	Next    time.Time     // next event time, on the wall timeline at the time of the snapshot
+	Period  time.Duration // (tickers only) time between ticks
+	Stopped bool          // stopped, but not removed from the clock yet
+	Label   string        // optional label, set with SetLabel
+	Caller  string        // file:line where the event was created
+}
+
+func (e Event) String() string {
+	s := e.Kind.String()
+	if e.Label != "" {
+		s += " " + strconv.Quote(e.Label)
+	}
+	s += " at " + e.Next.Format(time.RFC3339Nano)
+	if e.Period != 0 {
+		s += " every " + e.Period.String()
+	}
+	if e.Stopped {
+		s += " (stopped)"
+	}
+	return s + " created at " + e.Caller
+}
+
+// event is a timer, ticker or sleep controlled by a manual clock. Its mutable
+// fields are protected by the clock's eventsMutex.
 type event struct {
 	c       chan time.Time
 	clock   *manualClock  // the clock that controls this event
-	next    time.Time     // next event time
+	kind    Kind          // the feature the event was created by
+	callers []uintptr     // calling stack where the event was created
+	id      uint64        // creation sequence number, orders simultaneous events
+	rank    uint64        // (shuffle ordering only) random key, orders simultaneous events first
+	at      time.Duration // next event time, on the monotonic timeline
 	d       time.Duration // (tickers only) time between ticks
 	fn      func()        // (timers only) AfterFunc function
-	stopped bool          // (timers only) stopped or expired
-	removed bool          // (timers only) removed from event list
-	mu      sync.RWMutex  // protection for `stopped` and `removed` flags, and `next` field
+	label   string        // optional label
+	stopped bool          // stopped or (timers only) expired
+	index   int           // position in the clock's event queue, or -1 if not queued
 }
 
-func (e *event) Next() time.Time {
-	e.mu.RLock()
-	defer e.mu.RUnlock()
-	return e.next
+// callers returns the program counters of the calling stack, where the first
+// caller outside of the manual clock implementation can be found.
+func callers() []uintptr {
+	pcs := make([]uintptr, 8)
+	return pcs[:runtime.Callers(3, pcs)]
 }
 
-func (e *event) Stopped() bool {
-	e.mu.RLock()
-	defer e.mu.RUnlock()
-	return e.stopped
+// caller returns the file:line of the first caller outside of the manual clock
+// implementation, from the provided program counters.
+func caller(pcs []uintptr) string {
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		if !strings.Contains(f.Function, "/manualclock.(*manualClock).") || !more {
+			return filepath.Base(f.File) + ":" + strconv.Itoa(f.Line)
+		}
+	}
 }
 
-func (e *event) play(now time.Time) {
-	if e.Stopped() {
-		return
+// snapshot returns a snapshot of the event. The caller must hold the clock's eventsMutex.
+func (e *event) snapshot() Event {
+	return Event{
+		Kind:    e.kind,
+		Next:    e.clock.wall(e.at),
+		Period:  e.d,
+		Stopped: e.stopped,
+		Label:   e.label,
+		Caller:  caller(e.callers),
 	}
+}
 
-	var f func()
-
-	e.mu.Lock()
-	if e.fn != nil {
-		f = e.fn
-		// time.Sleep(time.Millisecond)
-	} else {
-		f = func() {
-			select {
-			case e.c <- now:
-				// time.Sleep(time.Millisecond)
-			default:
-			}
-		}
-	}
-	if e.d != 0 {
-		e.next = now.Add(e.d)
-	} else {
-		e.stopped = true
+func (e *event) setLabel(label string) {
+	e.clock.eventsMutex.Lock()
+	e.label = label
+	e.clock.eventsMutex.Unlock()
+}
+
+// send sends the provided time on the event channel, unless a previous value was
+// not received yet, and reports whether a goroutine was blocked receiving it. The
+// runtime hands a value over directly to a blocked receiver, rather than through
+// the buffer, so the channel is then still empty. The caller must hold the clock's
+// eventsMutex.
+func (e *event) send(now time.Time) bool {
+	select {
+	case e.c <- now:
+		return len(e.c) == 0
+	default:
+		return false
 	}
-	e.mu.Unlock()
+}
 
-	f()
+// drain discards the value sent on the event channel but not received yet, if
+// any, reporting whether there was one. Under the legacy timer channel semantics
+// it does nothing. The caller must hold the clock's eventsMutex.
+func (e *event) drain() bool {
+	if e.clock.legacy {
+		return false
+	}
+	select {
+	case <-e.c:
+		return true
+	default:
+		return false
+	}
 }
 
 // Timer represents an event timer similar to time.Timer, except it is controlled by a manual clock.
@@ -80,26 +159,29 @@ func (t *Timer) C() <-chan time.Time {
 	return t.c
 }
 
-// Stop turns off the timer.
+// Stop turns off the timer. It returns true if the timer was active, including
+// when it expired but its value was not received yet: that value is discarded.
 func (t *Timer) Stop() bool {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	active := !t.stopped
-	t.stopped = true
-	return active
+	t.clock.eventsMutex.Lock()
+	defer t.clock.eventsMutex.Unlock()
+	active := t.clock.stop((*event)(t))
+	return (*event)(t).drain() || active
+}
+
+// SetLabel attaches a label to the timer, to identify it in snapshots of pending events.
+func (t *Timer) SetLabel(label string) {
+	(*event)(t).setLabel(label)
 }
 
 // Reset changes the expiry time of the timer, and reactivates it if it was stopped.
+// As with Stop, a value that was not received yet is discarded.
 func (t *Timer) Reset(d time.Duration) bool {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.next = t.clock.Now().Add(d)
-	active := !t.stopped
-	t.stopped = false
-	if t.removed {
-		t.clock.addEvent((*event)(t))
-		t.removed = false
-	}
+	mc := t.clock
+	at := mc.monotonic() + max(d, 0)
+	mc.eventsMutex.Lock()
+	defer mc.eventsMutex.Unlock()
+	active := (*event)(t).drain() || !t.stopped
+	mc.schedule((*event)(t), at)
 	return active
 }
 
@@ -111,16 +193,82 @@ func (t *Ticker) C() <-chan time.Time {
 	return t.c
 }
 
-// Stop turns off the ticker.
+// SetLabel attaches a label to the ticker, to identify it in snapshots of pending events.
+func (t *Ticker) SetLabel(label string) {
+	(*event)(t).setLabel(label)
+}
+
+// Reset stops the ticker and resets its period to the specified duration, then
+// reactivates it. The next tick will arrive after the new period elapses.
+// It panics if d <= 0.
+func (t *Ticker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("manualclock: non-positive interval for Ticker.Reset")
+	}
+	mc := t.clock
+	at := mc.monotonic() + d
+	mc.eventsMutex.Lock()
+	defer mc.eventsMutex.Unlock()
+	t.d = d
+	(*event)(t).drain()
+	mc.schedule((*event)(t), at)
+}
+
+// Stop turns off the ticker, discarding any tick that was not received yet.
 func (t *Ticker) Stop() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.stopped = true
+	t.clock.eventsMutex.Lock()
+	defer t.clock.eventsMutex.Unlock()
+	t.clock.stop((*event)(t))
+	(*event)(t).drain()
 }
 
-// events represents a list of sortable events.
+// before reports whether event a is due before event b: either sooner, or at
+// the same time but earlier according to the clock's ordering of simultaneous events.
+func before(a, b *event) bool {
+	if a.at == b.at {
+		switch {
+		case a.clock.order == OrderLIFO:
+			return a.id > b.id
+		case a.clock.order == OrderShuffle && a.rank != b.rank:
+			return a.rank < b.rank
+		}
+		return a.id < b.id
+	}
+	return a.at < b.at
+}
+
+// events represents a list of events sortable in the order they are due.
 type events []*event
 
 func (a events) Len() int           { return len(a) }
 func (a events) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a events) Less(i, j int) bool { return a[i].Next().After(a[j].Next()) }
+func (a events) Less(i, j int) bool { return before(a[i], a[j]) }
+
+// queue represents a priority queue of events, implementing heap.Interface.
+// Events keep track of their own position in the queue, so that they can be
+// rescheduled in O(log n) time.
+type queue []*event
+
+func (q queue) Len() int           { return len(q) }
+func (q queue) Less(i, j int) bool { return before(q[i], q[j]) }
+func (q queue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *queue) Push(x interface{}) {
+	e := x.(*event)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *queue) Pop() interface{} {
+	old := *q
+	n := len(old) - 1
+	e := old[n]
+	old[n] = nil
+	e.index = -1
+	*q = old[:n]
+	return e
+}
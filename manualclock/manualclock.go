@@ -13,9 +13,44 @@
 // limitations under the License.
 
 // Package manualclock provides a clock that only advances when explicitly told to.
+//
+// When the clock is moved, every timer or ticker event that falls in the interval
+// is played in order, and the clock waits for the goroutines woken by each event
+// to settle before playing the next one. The clock accounts for the goroutines it
+// wakes itself: the one running an AfterFunc function, which is waited for until it
+// returns or blocks, and the receiver of a value sent on a timer or ticker channel,
+// if one was blocked on it. As the runtime hands the value over directly to such a
+// receiver, the clock knows that one was woken, but not which one, so it waits for
+// all the goroutines that were waiting before the value was sent. Events that wake
+// no goroutine, e.g. a timer whose channel nobody receives from yet, are played
+// without waiting, and goroutines woken otherwise, e.g. by an AfterFunc function,
+// are not waited for, so unrelated goroutines cannot delay or block the clock.
+// The goroutines of the code under test can also be launched through the clock's
+// Go method, so that only these are considered as receivers. A goroutine that
+// never settles, e.g. stuck in a busy loop, makes the move panic with a *BusyError
+// after the settle timeout, rather than hang.
+//
+// Events due at the same time are played in the order they were created, so that
+// runs are reproducible, unless another ordering is selected with WithOrdering or
+// WithShuffle.
+//
+// Like a real process, the clock keeps a wall time, reported by Now, and a
+// monotonic timeline, followed by timers, tickers and sleeps, and used by Since
+// and Until. Moving the clock forwards advances both, while StepWall, or moving
+// the clock backwards, only changes the wall time.
+//
+// A manual clock can be used inside a testing/synctest bubble: while waiting for
+// goroutines to settle, it never sleeps on the fake time of the bubble, which could
+// otherwise deadlock when a goroutine is blocked on something other than a channel
+// or timer, e.g. a mutex. As the bubble hides the real time, a settle timeout then
+// only enables the limit, and the clock gives up after a fixed number of checks of
+// goroutine status, which take a few seconds of real time with a thousand goroutines.
 package manualclock
 
 import (
+	"container/heap"
+	"errors"
+	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -23,98 +58,632 @@ import (
 	"github.com/agext/clocks"
 )
 
+// Clock is the interface implemented by manual clocks. Besides the features common
+// to all clocks, it provides ways to synchronize tests with the code they exercise.
+type Clock interface {
+	clocks.Clock
+
+	// BlockUntil blocks until at least n timers, tickers or sleeps are pending on
+	// the clock, i.e. created or reset and neither stopped nor expired. If timeout
+	// is positive, BlockUntil gives up after that much real time has elapsed.
+	// It reports whether n events were pending.
+	BlockUntil(n int, timeout time.Duration) bool
+
+	// Pending returns a snapshot of the timers, tickers and sleeps controlled by
+	// the clock, in the order they are due. Expired timers and sleeps are not
+	// included. Stopped events may be, flagged as such, until they are lazily
+	// removed, which can happen whenever an event is stopped or the clock moves.
+	Pending() []Event
+
+	// Changed returns a channel that is closed the next time a timer, ticker or
+	// sleep is created, reset, stopped or expires on the clock.
+	Changed() <-chan struct{}
+
+	// AdvanceToNext moves the clock to the time of the next pending event, playing
+	// it, and returns how far the clock moved. It does nothing if no events are
+	// pending.
+	AdvanceToNext() time.Duration
+
+	// RunUntilIdle keeps moving the clock to the next pending event, until no
+	// events are pending or the next one is more than limit after the time when
+	// RunUntilIdle was called. It returns how far the clock moved, and whether it
+	// stopped because no events were pending.
+	RunUntilIdle(limit time.Duration) (time.Duration, bool)
+
+	// StepWall moves the wall time by d, without advancing the monotonic timeline
+	// that timers, tickers and sleeps follow, and without triggering any of them.
+	StepWall(d time.Duration)
+
+	// SetBackwardPolicy selects what happens when the clock is set to an earlier
+	// time, including by Add with a negative duration.
+	SetBackwardPolicy(p BackwardPolicy)
+
+	// SetSettleTimeout sets how much real time the goroutines woken by each event
+	// are given to settle, when the clock moves. If they don't, the move panics
+	// with a *BusyError. A non-positive timeout waits indefinitely.
+	SetSettleTimeout(d time.Duration)
+
+	// AutoAdvance starts a simulation mode, where the clock automatically moves
+	// to the next pending event whenever all the goroutines that depend on it are
+	// blocked. It returns a function that ends the simulation mode, and returns
+	// the *BusyError that ended it early, if any.
+	AutoAdvance() (stop func() error)
+
+	// Go calls f in a new goroutine that depends on the clock. Once Go has been
+	// called, only the goroutines launched through it are waited for when they
+	// receive an event, rather than every goroutine that was waiting.
+	Go(f func())
+
+	// WaitIdle blocks until all the goroutines that depend on the clock, other
+	// than the calling one, are waiting, e.g. once the ones woken by the latest
+	// move of the clock have settled. If timeout is positive, WaitIdle gives up
+	// after that much real time has elapsed, and returns a *BusyError listing the
+	// goroutines still running.
+	WaitIdle(timeout time.Duration) error
+}
+
+// BackwardPolicy defines what happens when a manual clock is set to an earlier time.
+type BackwardPolicy int
+
+// Policies for setting a manual clock backwards.
+const (
+	// BackwardKeepDurations steps the wall time back, like StepWall: pending
+	// timers, tickers and sleeps keep their remaining durations. This is the default.
+	BackwardKeepDurations BackwardPolicy = iota
+	// BackwardKeepDeadlines steps the wall time back, and postpones pending timers,
+	// tickers and sleeps so that they stay due at the same wall time.
+	BackwardKeepDeadlines
+	// BackwardReject leaves the clock unchanged, and panics with ErrBackward.
+	BackwardReject
+)
+
+// ErrBackward is the panic value when a manual clock rejects being set backwards.
+var ErrBackward = errors.New("manualclock: clock set backwards")
+
+// DefaultSettleTimeout is the real time the goroutines woken by each event of a
+// manual clock are given to settle, unless changed with SetSettleTimeout.
+const DefaultSettleTimeout = 10 * time.Second
+
 // manualClock represents a clock that only advances when explicitly told to.
 // A pointer to it satisfies the Clock interface.
 type manualClock struct {
-	now            time.Time    // current time
-	events         events       // dependent events (e.g. tickers & timers)
-	newEvents      events       // buffer for adding dependent events
-	nowMutex       sync.RWMutex // protection for current time
-	eventsMutex    sync.Mutex   // protection for event list
-	newEventsMutex sync.Mutex   // protection for event buffer
+	now            time.Time      // current time
+	loc            *time.Location // location of the reported times, if set
+	mono           time.Duration  // current time on the monotonic timeline, since creation
+	segments       []segment      // stretches of the monotonic timeline between wall time steps, oldest first
+	events         queue          // dependent events (e.g. tickers & timers)
+	stale          int            // number of stopped events still in the queue
+	lastID         uint64         // id of the most recently created event
+	pending        int            // number of pending events
+	pendingChanged chan struct{}  // closed when `pending` changes, if not nil
+	legacy         bool           // pre-Go 1.23 timer channels: stale values are not drained
+	backward       BackwardPolicy // what happens when the clock is set backwards
+	settle         time.Duration  // real time allowed for woken goroutines to settle
+	strategy       WaitStrategy   // how to wait for woken goroutines to settle
+	interval       time.Duration  // longest pause between checks for goroutines to settle
+	order          Ordering       // order of the events due at the same time
+	shuffle        *rand.Rand     // (shuffle ordering only) source of event ranks, protected by eventsMutex
+	tracker        tracker        // goroutines that depend on this clock
+	nowMutex       sync.RWMutex   // protection for `now`, `mono` and `segments`
+	eventsMutex    sync.Mutex     // protection for events, including their scheduling, and counters
+	setMutex       sync.Mutex     // serialization of clock moves, and protection for `backward` and `settle`
+}
+
+// New returns a manual clock instance set to the current time, unless configured
+// otherwise by the provided options.
+//
+// Its timers and tickers follow the channel semantics of the time package as of
+// Go 1.23: no stale value is received after Stop or Reset. Whenever the timers of
+// the time package follow the legacy semantics instead, e.g. with Go 1.22, or with
+// asynctimerchan=1 in GODEBUG, so do the ones of the clock; this is checked when
+// the clock is created.
+func New(opts ...Option) Clock {
+	mc := &manualClock{
+		now:      time.Now(),
+		legacy:   asyncTimerChan(),
+		settle:   DefaultSettleTimeout,
+		interval: DefaultPollInterval,
+	}
+	for _, opt := range opts {
+		opt(mc)
+	}
+	if mc.order == OrderShuffle && mc.shuffle == nil {
+		mc.shuffle = rand.New(rand.NewSource(1))
+	}
+	if mc.loc != nil {
+		mc.now = mc.now.In(mc.loc)
+	}
+	mc.segments = []segment{{wall: mc.now.Round(0)}}
+	return mc
 }
 
-// New returns a manual clock instance set to the current time.
-func New() clocks.Clock {
-	return &manualClock{now: time.Now()}
+// asyncTimerChan reports whether the timers of the time package currently follow
+// the pre-Go 1.23 channel semantics. Their channels are only buffered then, which
+// reflects every source of the asynctimerchan setting: the GODEBUG environment
+// variable, as well as the default of the binary, set by //go:debug directives or
+// derived from the Go version of the main module (Go 1.20 in GOPATH mode).
+func asyncTimerChan() bool {
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	return cap(t.C) > 0
 }
 
-// addEvent adds the provided event to the list maintained and controlled by this clock.
+// addEvent adds the provided event to the queue maintained and controlled by this clock.
 func (mc *manualClock) addEvent(e *event) {
-	mc.newEventsMutex.Lock()
-	mc.newEvents = append(mc.newEvents, e)
-	mc.newEventsMutex.Unlock()
+	mc.eventsMutex.Lock()
+	mc.lastID++
+	e.id = mc.lastID
+	e.index = -1
+	mc.schedule(e, e.at)
+	mc.eventsMutex.Unlock()
+}
+
+// schedule sets the next time of the event, on the monotonic timeline, and
+// (re)activates it. The caller must hold the eventsMutex.
+func (mc *manualClock) schedule(e *event, at time.Duration) {
+	e.at = at
+	mc.rank(e)
+	if e.index < 0 {
+		heap.Push(&mc.events, e)
+		mc.notify(1)
+	} else {
+		if e.stopped {
+			mc.stale--
+			mc.notify(1)
+		} else {
+			// rescheduled while active
+			mc.notify(0)
+		}
+		heap.Fix(&mc.events, e.index)
+	}
+	e.stopped = false
+}
+
+// rank draws the random key that orders the event among simultaneous ones, under
+// the shuffle ordering. The caller must hold the eventsMutex.
+func (mc *manualClock) rank(e *event) {
+	if mc.shuffle != nil {
+		e.rank = mc.shuffle.Uint64()
+	}
+}
+
+// stop deactivates the event, reporting whether it was active. Active events are
+// always queued, while stopped ones are removed from the queue lazily, either
+// when they are due or when they make up more than half of it.
+// The caller must hold the eventsMutex.
+func (mc *manualClock) stop(e *event) bool {
+	if e.stopped {
+		return false
+	}
+	e.stopped = true
+	mc.notify(-1)
+	mc.stale++
+	if mc.stale > len(mc.events)/2 {
+		mc.compact()
+	}
+	return true
+}
+
+// compact removes all stopped events from the queue. The caller must hold the eventsMutex.
+func (mc *manualClock) compact() {
+	q := mc.events[:0]
+	for _, e := range mc.events {
+		if e.stopped {
+			e.index = -1
+			continue
+		}
+		e.index = len(q)
+		q = append(q, e)
+	}
+	for i := len(q); i < len(mc.events); i++ {
+		mc.events[i] = nil
+	}
+	mc.events = q
+	mc.stale = 0
+	heap.Init(&mc.events)
+}
+
+// first returns the next active event in the queue, if any, removing the stopped
+// events that are due before it. The caller must hold the eventsMutex.
+func (mc *manualClock) first() *event {
+	for len(mc.events) > 0 {
+		e := mc.events[0]
+		if !e.stopped {
+			return e
+		}
+		heap.Pop(&mc.events)
+		mc.stale--
+	}
+	return nil
+}
+
+// notify updates the number of pending events by delta, waking up any goroutine
+// blocked in BlockUntil or waiting on Changed. The caller must hold the eventsMutex.
+func (mc *manualClock) notify(delta int) {
+	mc.pending += delta
+	if mc.pendingChanged != nil {
+		close(mc.pendingChanged)
+		mc.pendingChanged = nil
+	}
+}
+
+// Changed returns a channel that is closed the next time a timer, ticker or sleep
+// is created, reset, stopped or expires on the clock.
+func (mc *manualClock) Changed() <-chan struct{} {
+	mc.eventsMutex.Lock()
+	defer mc.eventsMutex.Unlock()
+	if mc.pendingChanged == nil {
+		mc.pendingChanged = make(chan struct{})
+	}
+	return mc.pendingChanged
+}
+
+// BlockUntil blocks until at least n timers, tickers or sleeps are pending on
+// the clock, or until the timeout elapses in real time, if positive. It reports
+// whether n events were pending.
+func (mc *manualClock) BlockUntil(n int, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	for {
+		mc.eventsMutex.Lock()
+		if mc.pending >= n {
+			mc.eventsMutex.Unlock()
+			return true
+		}
+		if mc.pendingChanged == nil {
+			mc.pendingChanged = make(chan struct{})
+		}
+		changed := mc.pendingChanged
+		mc.eventsMutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-expired:
+			return false
+		}
+	}
 }
 
 // Add moves the the manual clock by the specified duration, triggering any ticker or
 // timer activity that would occur in the time interval between the old and new times.
 func (mc *manualClock) Add(d time.Duration) {
-	mc.Set(mc.Now().Add(d))
+	mc.setMutex.Lock()
+	defer mc.setMutex.Unlock()
+	mc.set(mc.Now().Add(d))
 }
 
 // Set moves the manual clock to the specified time, triggering any ticker or
 // timer activity that would occur in the time interval between the old and new times.
+// Moving the clock forwards also advances its monotonic timeline, while moving it
+// backwards only steps the wall time, according to the backward policy.
 func (mc *manualClock) Set(now time.Time) {
+	mc.setMutex.Lock()
+	defer mc.setMutex.Unlock()
+	mc.set(now)
+}
+
+// set implements Set. The caller must hold the setMutex, so that moves relative
+// to the current time start from where any concurrent move ended.
+func (mc *manualClock) set(now time.Time) {
+	mono := mc.monotonic()
+	d := now.Round(0).Sub(mc.Now().Round(0))
+	switch {
+	case d >= 0:
+		mono += d
+		mc.advance(mono)
+	case d < 0 && mc.backward == BackwardReject:
+		panic(ErrBackward)
+	case d < 0 && mc.backward == BackwardKeepDeadlines:
+		mc.postpone(-d)
+	}
+	mc.setNow(now, mono)
+}
+
+// SetBackwardPolicy selects what happens when the clock is set to an earlier time.
+func (mc *manualClock) SetBackwardPolicy(p BackwardPolicy) {
+	mc.setMutex.Lock()
+	mc.backward = p
+	mc.setMutex.Unlock()
+}
+
+// SetSettleTimeout sets how much real time the goroutines woken by each event are
+// given to settle, when the clock moves. A non-positive timeout waits indefinitely.
+func (mc *manualClock) SetSettleTimeout(d time.Duration) {
+	mc.setMutex.Lock()
+	mc.settle = d
+	mc.setMutex.Unlock()
+}
+
+// postpone delays all the events in the queue by d on the monotonic timeline.
+// Their order is unchanged.
+func (mc *manualClock) postpone(d time.Duration) {
 	mc.eventsMutex.Lock()
-	defer func() {
-		mc.nowMutex.Lock()
-		mc.now = now
-		mc.nowMutex.Unlock()
-		mc.eventsMutex.Unlock()
-	}()
+	for _, e := range mc.events {
+		e.at += d
+	}
+	mc.eventsMutex.Unlock()
+}
 
-	mc.newEventsMutex.Lock()
-	mc.events = append(mc.events, mc.newEvents...)
-	mc.newEvents = mc.newEvents[:0]
-	mc.newEventsMutex.Unlock()
+// StepWall moves the wall time of the manual clock by d, without advancing its
+// monotonic timeline: pending events keep their remaining durations, and no event
+// is triggered. This is how the system clock behaves when adjusted, e.g. by NTP.
+func (mc *manualClock) StepWall(d time.Duration) {
+	mc.setMutex.Lock()
+	defer mc.setMutex.Unlock()
+	mc.setNow(mc.Now().Add(d), mc.monotonic())
+}
 
-	if len(mc.events) == 0 {
-		return
+// advance moves the monotonic timeline forwards to end, playing the events that
+// are due in order. After each event that woke a goroutine, it waits for them to
+// settle, and panics with a *BusyError if they do not within the settle timeout.
+// The caller must hold the setMutex.
+func (mc *manualClock) advance(end time.Duration) {
+	var wp *waitpoint
+	for {
+		mc.eventsMutex.Lock()
+		e := mc.first()
+		if e == nil || e.at > end {
+			mc.eventsMutex.Unlock()
+			return
+		}
+		at := e.at
+		if e.d != 0 {
+			e.at = at + e.d
+			mc.rank(e)
+			heap.Fix(&mc.events, e.index)
+		} else {
+			heap.Pop(&mc.events)
+			e.stopped = true
+			mc.notify(-1)
+		}
+		now := mc.wall(at)
+		mc.setNow(now, at)
+		if wp == nil {
+			wp = mc.newWaitpoint()
+		} else {
+			wp.Reset()
+		}
+		woken := false
+		if e.fn == nil {
+			wp.Snapshot()
+			// sent while holding the lock, so that Stop and Reset can drain it
+			woken = e.send(now)
+		}
+		mc.eventsMutex.Unlock()
+
+		if e.fn != nil {
+			wp.Go(e.fn)
+		} else if woken {
+			wp.Woken()
+		}
+		if err := wp.Wait(mc.settle); err != nil {
+			panic(err)
+		}
 	}
+}
+
+// newWaitpoint returns a waitpoint for the goroutines that depend on the clock,
+// following its wait strategy.
+func (mc *manualClock) newWaitpoint() *waitpoint {
+	return newWaitpoint(&mc.tracker, mc.strategy, mc.interval)
+}
 
-	sort.Sort(mc.events)
-	last, first := 0, len(mc.events)-1
-	for last <= first && mc.events[last].Next().After(now) {
-		last++
+// setNow changes the current wall and monotonic times of the manual clock,
+// without any other effect.
+func (mc *manualClock) setNow(now time.Time, mono time.Duration) {
+	if mc.loc != nil {
+		now = now.In(mc.loc)
 	}
+	mc.nowMutex.Lock()
+	mc.now = now
+	mc.mono = mono
+	if s := mc.segments[len(mc.segments)-1]; now.Round(0).Sub(s.wall) != mono-s.mono {
+		// the wall time was stepped
+		mc.segments = append(mc.segments, segment{mono: mono, wall: now.Round(0)})
+	}
+	mc.nowMutex.Unlock()
+}
 
-	if last > first {
-		return
+// segment is a stretch of the monotonic timeline during which the wall time of a
+// manual clock was not stepped. It lasts until the next segment starts, or until
+// the current time for the last one.
+type segment struct {
+	mono time.Duration // start on the monotonic timeline
+	wall time.Time     // wall time at the start, without monotonic reading
+}
+
+// monotonic returns the current time on the monotonic timeline.
+func (mc *manualClock) monotonic() time.Duration {
+	mc.nowMutex.RLock()
+	defer mc.nowMutex.RUnlock()
+	return mc.mono
+}
+
+// wall returns the wall time corresponding to the monotonic time at, assuming
+// the wall time is not stepped in the meantime.
+func (mc *manualClock) wall(at time.Duration) time.Time {
+	mc.nowMutex.RLock()
+	defer mc.nowMutex.RUnlock()
+	return mc.now.Add(at - mc.mono)
+}
+
+// reading returns the time on the monotonic timeline that corresponds to t: the
+// time when the clock was at t, or, if it never was, the one on the current wall
+// timeline. If the wall time was stepped back to t again, the latest one wins.
+// It only keeps track of the wall time steps, so its cost does not grow with the
+// number of events played. The caller must hold the nowMutex.
+func (mc *manualClock) reading(t time.Time) time.Duration {
+	t = t.Round(0)
+	end := mc.mono
+	for i := len(mc.segments) - 1; i >= 0; i-- {
+		s := mc.segments[i]
+		if d := t.Sub(s.wall); d >= 0 && d <= end-s.mono {
+			return s.mono + d
+		}
+		end = s.mono
 	}
+	return mc.mono + t.Sub(mc.now.Round(0))
+}
+
+// Go calls f in a new goroutine that depends on the clock, and which is waited for
+// whenever the clock moves. Once Go has been called, only the goroutines launched
+// through it are waited for when they receive an event, rather than every goroutine
+// that was waiting. Goroutines started by f with a go statement are not waited for.
+func (mc *manualClock) Go(f func()) {
+	mc.tracker.Explicit()
+	started := make(chan struct{})
+	go func() {
+		g := goid()
+		mc.tracker.Add(g)
+		defer mc.tracker.Untrack(g)
+		close(started)
+		f()
+	}()
+	<-started
+}
 
-	for e := mc.events[first]; !e.Next().After(now); e = mc.events[first] {
-		next := e.Next()
-		mc.nowMutex.Lock()
-		mc.now = next
-		mc.nowMutex.Unlock()
-		wp := newWaitpoint()
-		e.play(next)
-		wp.Wait()
-		if e.Stopped() {
-			mc.events = mc.events[:first]
-			e.mu.Lock()
-			e.removed = true
-			e.mu.Unlock()
+// WaitIdle blocks until all the goroutines that depend on the clock, other than
+// the calling one, are waiting. This includes the goroutines woken by the latest
+// move of the clock, but also the ones woken otherwise, e.g. by a message the test
+// sent them. Goroutines in a system call, e.g. the one delivering signals for
+// os/signal, count as waiting. If timeout is positive, WaitIdle gives up after that
+// much real time has elapsed, and returns a *BusyError listing the goroutines still
+// running.
+func (mc *manualClock) WaitIdle(timeout time.Duration) error {
+	wp := mc.newWaitpoint()
+	wp.WatchAll()
+	return wp.Wait(timeout)
+}
+
+// AutoAdvance starts a simulation mode, where the clock automatically moves to
+// the next pending event whenever all the goroutines that depend on it are blocked,
+// like the fake time of the Go playground. It returns a function that ends the
+// simulation mode, once any move in progress is complete; it may be called more
+// than once. If the goroutines woken by an event do not settle within the settle
+// timeout, the simulation mode ends, and the function returns the *BusyError.
+//
+// Goroutines are only considered blocked if they stay so across two checks, one
+// poll interval apart, so with the default interval of a real millisecond, a
+// simulation runs at up to about 500 events per second of real time. A goroutine
+// blocked for reasons unrelated to the clock, e.g. waiting for network input or
+// in a system call, counts as blocked.
+func (mc *manualClock) AutoAdvance() (stop func() error) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	var err error
+	go func() {
+		defer close(stopped)
+		wp := mc.newWaitpoint()
+		poll := time.NewTicker(mc.interval)
+		defer poll.Stop()
+		quiet := false
+		for {
+			select {
+			case <-done:
+				return
+			case <-poll.C:
+			}
+			if _, found := mc.next(); !found || !mc.tracker.idle(wp.grStatus(), wp.self) {
+				quiet = false
+				continue
+			}
+			if quiet {
+				if err = mc.tryAdvance(); err != nil {
+					return
+				}
+			}
+			quiet = !quiet
 		}
-		mc.newEventsMutex.Lock()
-		mc.events = append(mc.events, mc.newEvents...)
-		mc.newEvents = mc.newEvents[:0]
-		mc.newEventsMutex.Unlock()
+	}()
+	var once sync.Once
+	return func() error {
+		once.Do(func() { close(done) })
+		<-stopped
+		return err
+	}
+}
 
-		first = len(mc.events) - 1
-		if first < 0 {
-			break
+// tryAdvance moves the clock to the next pending event, like AdvanceToNext, and
+// returns the *BusyError the move panicked with, if any.
+func (mc *manualClock) tryAdvance() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			busy, ok := r.(*BusyError)
+			if !ok {
+				panic(r)
+			}
+			err = busy
 		}
+	}()
+	mc.AdvanceToNext()
+	return nil
+}
 
-		sort.Sort(mc.events[last:])
+// Pending returns a snapshot of the timers, tickers and sleeps controlled by the
+// clock, in the order they are due. Expired timers and sleeps are not included.
+// Stopped events may be, flagged as such, until they are lazily removed from the
+// queue, which can happen whenever an event is stopped or the clock moves.
+func (mc *manualClock) Pending() []Event {
+	mc.eventsMutex.Lock()
+	defer mc.eventsMutex.Unlock()
+	list := make(events, len(mc.events))
+	copy(list, mc.events)
+	sort.Sort(list)
+	pending := make([]Event, len(list))
+	for i, e := range list {
+		pending[i] = e.snapshot()
+	}
+	return pending
+}
 
-		for last <= first && mc.events[last].Next().After(now) {
-			last++
-		}
+// next returns the time of the next pending event on the monotonic timeline, if any.
+func (mc *manualClock) next() (time.Duration, bool) {
+	mc.eventsMutex.Lock()
+	defer mc.eventsMutex.Unlock()
+	if e := mc.first(); e != nil {
+		return e.at, true
+	}
+	return 0, false
+}
+
+// AdvanceToNext moves the clock to the time of the next pending event, playing
+// it, and returns how far the clock moved. It does nothing if no events are pending.
+func (mc *manualClock) AdvanceToNext() time.Duration {
+	mc.setMutex.Lock()
+	defer mc.setMutex.Unlock()
 
-		if last > first {
-			break
+	at, found := mc.next()
+	if !found {
+		return 0
+	}
+	d := at - mc.monotonic()
+	if d < 0 {
+		d = 0
+	}
+	mc.set(mc.Now().Add(d))
+	return d
+}
+
+// RunUntilIdle keeps moving the clock to the next pending event, until no events
+// are pending or the next one is more than limit after the time when RunUntilIdle
+// was called. It returns how far the clock moved, and whether it stopped because
+// no events were pending.
+func (mc *manualClock) RunUntilIdle(limit time.Duration) (time.Duration, bool) {
+	start := mc.monotonic()
+	end := start + limit
+	for {
+		at, found := mc.next()
+		if !found {
+			return mc.monotonic() - start, true
+		}
+		if at > end {
+			return mc.monotonic() - start, false
 		}
+		mc.AdvanceToNext()
 	}
 }
 
@@ -125,10 +694,29 @@ func (mc *manualClock) Now() time.Time {
 	return mc.now
 }
 
+// Since returns the time elapsed on the monotonic timeline of the manual clock
+// since t, which is not affected by moving the clock backwards.
+func (mc *manualClock) Since(t time.Time) time.Duration {
+	mc.nowMutex.RLock()
+	defer mc.nowMutex.RUnlock()
+	return mc.mono - mc.reading(t)
+}
+
+// Until returns the duration until t on the monotonic timeline of the manual clock.
+func (mc *manualClock) Until(t time.Time) time.Duration {
+	mc.nowMutex.RLock()
+	defer mc.nowMutex.RUnlock()
+	return mc.reading(t) - mc.mono
+}
+
 // Sleep pauses the current goroutine for the given duration on the manual clock.
-// The clock must be moved forward in another goroutine.
+// The clock must be moved forward in another goroutine. A zero or negative
+// duration causes Sleep to return immediately.
 func (mc *manualClock) Sleep(d time.Duration) {
-	<-mc.After(d)
+	if d <= 0 {
+		return
+	}
+	<-mc.newTimer(KindSleep, d, nil).C()
 }
 
 // After waits for the duration to elapse and then sends the current time on the returned channel.
@@ -136,38 +724,56 @@ func (mc *manualClock) After(d time.Duration) <-chan time.Time {
 	return mc.NewTimer(d).C()
 }
 
-// AfterFunc waits for the duration to elapse and then executes a function.
-// A Timer is returned that can be stopped.
+// AfterFunc waits for the duration to elapse and then calls f in its own goroutine.
+// A Timer is returned that can be stopped. The clock waits for f to return, or to
+// block, before playing the next event; if f moves the clock itself, that move
+// only happens once the current one is complete.
 func (mc *manualClock) AfterFunc(d time.Duration, f func()) clocks.Timer {
-	t := mc.NewTimer(d).(*Timer)
-	t.fn = f
-	return t
+	return mc.newTimer(KindAfterFunc, d, f)
 }
 
 // NewTimer returns a new instance of Timer, controlled by the manual clock.
 func (mc *manualClock) NewTimer(d time.Duration) clocks.Timer {
+	return mc.newTimer(KindTimer, d, nil)
+}
+
+// newTimer returns a new instance of Timer of the provided kind, controlled by
+// the manual clock, that calls f instead of sending on its channel if f is not nil.
+func (mc *manualClock) newTimer(kind Kind, d time.Duration, f func()) *Timer {
 	t := &Timer{
-		c:     make(chan time.Time, 1),
-		clock: mc,
-		next:  mc.Now().Add(d),
+		c:       make(chan time.Time, 1),
+		clock:   mc,
+		kind:    kind,
+		callers: callers(),
+		at:      mc.monotonic() + max(d, 0), // a timer never fires before it was started
+		fn:      f,
 	}
 	mc.addEvent((*event)(t))
 	return t
 }
 
 // Tick is a convenience function for Ticker().
-// It will return a ticker channel that cannot be stopped.
+// It will return a ticker channel that cannot be stopped, or nil if d <= 0.
 func (mc *manualClock) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
 	return mc.NewTicker(d).C()
 }
 
 // NewTicker returns a new instance of Ticker, controlled by the manual clock.
+// It panics if d <= 0.
 func (mc *manualClock) NewTicker(d time.Duration) clocks.Ticker {
+	if d <= 0 {
+		panic("manualclock: non-positive interval for NewTicker")
+	}
 	t := &Ticker{
-		c:     make(chan time.Time, 1),
-		clock: mc,
-		d:     d,
-		next:  mc.Now().Add(d),
+		c:       make(chan time.Time, 1),
+		clock:   mc,
+		kind:    KindTicker,
+		callers: callers(),
+		d:       d,
+		at:      mc.monotonic() + d,
 	}
 	mc.addEvent((*event)(t))
 	return t
@@ -15,8 +15,18 @@
 package manualclock
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/agext/clocks"
 )
 
 type eventStamp struct {
@@ -84,7 +94,9 @@ func Test_New(t *testing.T) {
 		timer.Reset(time.Second)
 	}()
 
-	time.Sleep(5 * time.Millisecond)
+	if !clock.BlockUntil(1, time.Second) {
+		t.Fatal(`the first sleep was not registered`)
+	}
 	now = clock.Now()
 	es := <-ch
 	if es.l != "start" {
@@ -201,3 +213,1058 @@ func Test_New(t *testing.T) {
 		t.Fatal(`AfterFunc timer reset did not reactivate timer`)
 	}
 }
+
+func Test_UnrelatedGoroutines(t *testing.T) {
+	clock := New()
+
+	var stop int32
+	woken := make(chan struct{})
+	go func() {
+		<-woken
+		// busy, but not depending on the clock
+		for atomic.LoadInt32(&stop) == 0 {
+			runtime.Gosched()
+		}
+	}()
+
+	fired := make(chan struct{}, 1)
+	go func() {
+		<-clock.After(time.Second)
+		fired <- struct{}{}
+	}()
+	clock.BlockUntil(1, time.Second)
+
+	clock.AfterFunc(time.Second, func() { close(woken) })
+	done := make(chan struct{})
+	go func() {
+		clock.Add(time.Second)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal(`Add() is blocked by a goroutine that does not depend on the clock`)
+	}
+	atomic.StoreInt32(&stop, 1)
+
+	select {
+	case <-fired:
+	default:
+		t.Error(`Add() returned before the dependent goroutine settled`)
+	}
+}
+
+func Test_ReceiveOnly(t *testing.T) {
+	clock := New()
+
+	for i := 0; i < 20; i++ {
+		// the consumer only receives on a channel created by another goroutine
+		ch := clock.After(time.Second)
+		var received int32
+		go func() {
+			<-ch
+			// busy for a while, without waiting
+			for start := time.Now(); time.Since(start) < time.Millisecond; {
+				runtime.Gosched()
+			}
+			atomic.StoreInt32(&received, 1)
+		}()
+		clock.WaitIdle(time.Second)
+
+		clock.Add(time.Second)
+		if atomic.LoadInt32(&received) == 0 {
+			t.Fatal(`Add() returned before the receiving goroutine settled`)
+		}
+	}
+}
+
+func Test_WithTimeout(t *testing.T) {
+	now := time.Now()
+	clock := New()
+	clock.Set(now)
+
+	ctx, cancel := clocks.WithTimeout(context.Background(), clock, time.Minute)
+	defer cancel()
+
+	if d, ok := ctx.Deadline(); !ok || d != now.Add(time.Minute) {
+		t.Errorf(`Deadline() is incorrect: want %s got %s`, now.Add(time.Minute), d)
+	}
+
+	clock.Add(59 * time.Second)
+	select {
+	case <-ctx.Done():
+		t.Fatal(`context expired too early`)
+	default:
+	}
+
+	clock.Add(time.Second)
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal(`context did not expire on time`)
+	}
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		t.Errorf(`unexpected error after timeout: want %v got %v`, context.DeadlineExceeded, err)
+	}
+}
+
+func Test_WithTimeoutParent(t *testing.T) {
+	clock := New(WithStart(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	// the real-time deadline of the parent is on another timeline
+	parent, pcancel := context.WithTimeout(context.Background(), time.Hour)
+	defer pcancel()
+	ctx, cancel := clocks.WithTimeout(parent, clock, time.Minute)
+	defer cancel()
+	if d, ok := ctx.Deadline(); !ok || !d.Equal(clock.Now().Add(time.Minute)) {
+		t.Errorf(`Deadline() is incorrect: want %s got %s`, clock.Now().Add(time.Minute), d)
+	}
+
+	child, ccancel := context.WithCancel(ctx)
+	defer ccancel()
+	clock.Add(2 * time.Minute)
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal(`context did not expire on time`)
+	}
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		t.Errorf(`unexpected error after timeout: want %v got %v`, context.DeadlineExceeded, err)
+	}
+	select {
+	case <-child.Done():
+	default:
+		t.Fatal(`derived context did not expire with its parent`)
+	}
+	if err := child.Err(); err != context.DeadlineExceeded {
+		t.Errorf(`unexpected error of derived context: want %v got %v`, context.DeadlineExceeded, err)
+	}
+	if err := context.Cause(child); err != context.DeadlineExceeded {
+		t.Errorf(`unexpected cause of derived context: want %v got %v`, context.DeadlineExceeded, err)
+	}
+}
+
+func Test_WithTimeoutCancel(t *testing.T) {
+	clock := New()
+
+	_, cancel := clocks.WithTimeout(context.Background(), clock, time.Minute)
+	if !clock.BlockUntil(1, 0) {
+		t.Fatal(`the context timer is not pending`)
+	}
+	cancel()
+	for _, e := range clock.Pending() {
+		if !e.Stopped {
+			t.Errorf(`the context timer is still pending after cancel(): %s`, e)
+		}
+	}
+}
+
+func Test_BlockUntil(t *testing.T) {
+	clock := New()
+
+	if !clock.BlockUntil(0, 0) {
+		t.Error(`BlockUntil(0) should not block`)
+	}
+
+	go clock.Sleep(time.Second)
+	go clock.NewTicker(time.Second)
+	if !clock.BlockUntil(2, time.Second) {
+		t.Fatal(`BlockUntil() did not see the pending sleep and ticker`)
+	}
+
+	timer := clock.NewTimer(time.Minute)
+	if !clock.BlockUntil(3, 0) {
+		t.Error(`BlockUntil() did not see the pending timer`)
+	}
+
+	clock.Add(time.Second)
+	if clock.BlockUntil(3, 10*time.Millisecond) {
+		t.Error(`BlockUntil() did not notice the expired sleep`)
+	}
+
+	timer.Stop()
+	if clock.BlockUntil(2, 10*time.Millisecond) {
+		t.Error(`BlockUntil() did not notice the stopped timer`)
+	}
+
+	done := make(chan bool)
+	go func() { done <- clock.BlockUntil(2, 0) }()
+	timer.Reset(time.Minute)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error(`BlockUntil() without timeout should not give up`)
+		}
+	case <-time.After(time.Second):
+		t.Error(`BlockUntil() did not notice the reset timer`)
+	}
+}
+
+func Test_Changed(t *testing.T) {
+	clock := New()
+
+	closed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	ch := clock.Changed()
+	if closed(ch) {
+		t.Fatal(`Changed() closed before any change`)
+	}
+	timer := clock.NewTimer(time.Minute)
+	if !closed(ch) {
+		t.Error(`Changed() not closed by a new timer`)
+	}
+	ch = clock.Changed()
+	timer.Reset(time.Hour)
+	if !closed(ch) {
+		t.Error(`Changed() not closed by a reset timer`)
+	}
+	ch = clock.Changed()
+	timer.Stop()
+	if !closed(ch) {
+		t.Error(`Changed() not closed by a stopped timer`)
+	}
+}
+
+func Test_Pending(t *testing.T) {
+	now := time.Now()
+	clock := New()
+	clock.Set(now)
+
+	if p := clock.Pending(); len(p) != 0 {
+		t.Fatalf(`unexpected pending events on a new clock: %v`, p)
+	}
+
+	retry := clock.NewTimer(30 * time.Second)
+	retry.(*Timer).SetLabel("retry")
+	ticker := clock.NewTicker(time.Minute)
+	clock.AfterFunc(10*time.Second, func() {})
+	go func() { clock.Sleep(time.Hour) }()
+	clock.BlockUntil(4, time.Second)
+
+	pending := clock.Pending()
+	exp := []Event{
+		{Kind: KindAfterFunc, Next: now.Add(10 * time.Second)},
+		{Kind: KindTimer, Next: now.Add(30 * time.Second), Label: "retry"},
+		{Kind: KindTicker, Next: now.Add(time.Minute), Period: time.Minute},
+		{Kind: KindSleep, Next: now.Add(time.Hour)},
+	}
+	if len(pending) != len(exp) {
+		t.Fatalf(`unexpected pending events: want %d got %v`, len(exp), pending)
+	}
+	for i, e := range pending {
+		if !strings.HasPrefix(e.Caller, "manualclock_test.go:") {
+			t.Errorf(`event #%d has incorrect caller: %s`, i, e.Caller)
+		}
+		e.Caller = ""
+		if e != exp[i] {
+			t.Errorf(`event #%d is incorrect: want %v got %v`, i, exp[i], e)
+		}
+	}
+
+	ticker.Stop()
+	if p := clock.Pending(); !p[2].Stopped {
+		t.Errorf(`stopped ticker is not reported as stopped: %v`, p[2])
+	}
+
+	clock.Add(2 * time.Minute)
+	pending = clock.Pending()
+	if len(pending) != 1 || pending[0].Kind != KindSleep {
+		t.Errorf(`unexpected pending events after moving the clock: %v`, pending)
+	}
+	if s := pending[0].String(); !strings.HasPrefix(s, "sleep at ") {
+		t.Errorf(`unexpected event description: %s`, s)
+	}
+}
+
+func Test_AdvanceToNext(t *testing.T) {
+	now := time.Now()
+	clock := New()
+	clock.Set(now)
+
+	if d := clock.AdvanceToNext(); d != 0 || clock.Now() != now {
+		t.Errorf(`AdvanceToNext() without pending events should not move the clock, moved %s`, d)
+	}
+
+	timer := clock.NewTimer(time.Hour)
+	clock.NewTimer(time.Minute).Stop()
+	if d := clock.AdvanceToNext(); d != time.Hour {
+		t.Errorf(`AdvanceToNext() is incorrect: want %s got %s`, time.Hour, d)
+	}
+	select {
+	case <-timer.C():
+	default:
+		t.Error(`AdvanceToNext() did not fire the next timer`)
+	}
+}
+
+func Test_RunUntilIdle(t *testing.T) {
+	now := time.Now()
+	clock := New()
+	clock.Set(now)
+
+	ch := make(chan time.Duration, 10)
+	go func() {
+		// exponential backoff
+		for d := time.Second; d <= 16*time.Second; d *= 2 {
+			clock.Sleep(d)
+			ch <- d
+		}
+		close(ch)
+	}()
+	clock.BlockUntil(1, time.Second)
+
+	if d, idle := clock.RunUntilIdle(time.Hour); d != 31*time.Second || !idle {
+		t.Errorf(`RunUntilIdle() is incorrect: want %s, idle got %s, %v`, 31*time.Second, d, idle)
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != 5 {
+		t.Errorf(`unexpected number of sleeps: want %d got %d`, 5, n)
+	}
+
+	ticker := clock.NewTicker(time.Minute)
+	if d, idle := clock.RunUntilIdle(time.Hour); d != time.Hour || idle {
+		t.Errorf(`RunUntilIdle() with a ticker is incorrect: want %s, not idle got %s, %v`, time.Hour, d, idle)
+	}
+	ticker.Stop()
+	if d, idle := clock.RunUntilIdle(time.Hour); d != 0 || !idle {
+		t.Errorf(`RunUntilIdle() after stopping the ticker is incorrect: want %s, idle got %s, %v`, time.Duration(0), d, idle)
+	}
+}
+
+func Test_ManyTimers(t *testing.T) {
+	now := time.Now()
+	clock := New()
+	clock.Set(now)
+
+	const n = 100000
+	var fired int
+	last := now
+	timers := make([]clocks.Timer, n)
+	for i := range timers {
+		// spread over an hour, in a scrambled order
+		timers[i] = clock.AfterFunc(time.Duration(i*7919%n)*time.Hour/n, func() {
+			if clock.Now().Before(last) {
+				t.Errorf(`timer fired out of order at %s`, clock.Now())
+			}
+			last = clock.Now()
+			fired++
+		})
+	}
+	for i := 0; i < n; i += 2 {
+		timers[i].Stop()
+	}
+
+	start := time.Now()
+	clock.Add(time.Hour)
+	if fired != n/2 {
+		t.Errorf(`unexpected number of timers fired: want %d got %d`, n/2, fired)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf(`firing %d timers took too long: %s`, n/2, elapsed)
+	}
+}
+
+func Test_ManyGoroutines(t *testing.T) {
+	clock := New()
+
+	// goroutines that are not woken by the timers
+	quit := make(chan struct{})
+	defer close(quit)
+	for i := 0; i < 200; i++ {
+		go func() { <-quit }()
+	}
+
+	const n = 10000
+	for i := 0; i < n; i++ {
+		clock.NewTimer(time.Duration(i+1) * time.Millisecond)
+	}
+	start := time.Now()
+	clock.Add(time.Hour)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf(`firing %d timers took too long: %s`, n, elapsed)
+	}
+}
+
+func Test_TickerReset(t *testing.T) {
+	now := time.Now()
+	clock := New()
+	clock.Set(now)
+
+	ticker := clock.NewTicker(time.Second)
+	clock.Add(500 * time.Millisecond)
+	ticker.Reset(time.Minute)
+
+	clock.Add(time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal(`ticker fired on its old period after Reset()`)
+	default:
+	}
+
+	clock.Add(59 * time.Second)
+	select {
+	case rt := <-ticker.C():
+		if exp := now.Add(time.Minute + 500*time.Millisecond); rt != exp {
+			t.Errorf(`tick time is incorrect by %s`, rt.Sub(exp))
+		}
+	default:
+		t.Fatal(`ticker did not fire on its new period after Reset()`)
+	}
+
+	ticker.Stop()
+	ticker.Reset(time.Second)
+	clock.Add(time.Second)
+	select {
+	case <-ticker.C():
+	default:
+		t.Error(`Reset() did not reactivate a stopped ticker`)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error(`Reset() should panic on a non-positive interval`)
+		}
+	}()
+	ticker.Reset(0)
+}
+
+func Test_StaleValues(t *testing.T) {
+	clock := New(WithLegacyTimerChan(false))
+
+	timer := clock.NewTimer(time.Second)
+	clock.Add(time.Second)
+	if !timer.Reset(time.Minute) {
+		t.Error(`Reset() should report an expired timer whose value was not received as active`)
+	}
+	select {
+	case <-timer.C():
+		t.Fatal(`stale value received after Reset()`)
+	default:
+	}
+	clock.Add(time.Minute)
+	if !timer.Stop() {
+		t.Error(`Stop() should report an expired timer whose value was not received as active`)
+	}
+	select {
+	case <-timer.C():
+		t.Fatal(`stale value received after Stop()`)
+	default:
+	}
+	if timer.Stop() {
+		t.Error(`Stop() should report a stopped timer as inactive`)
+	}
+
+	ticker := clock.NewTicker(time.Second)
+	clock.Add(time.Second)
+	ticker.Reset(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Fatal(`stale tick received after Reset()`)
+	default:
+	}
+	clock.Add(time.Minute)
+	ticker.Stop()
+	select {
+	case <-ticker.C():
+		t.Fatal(`stale tick received after Stop()`)
+	default:
+	}
+}
+
+func Test_AsyncTimerChan(t *testing.T) {
+	t.Setenv("GODEBUG", "asynctimerchan=1")
+	if !asyncTimerChan() {
+		t.Skip(`the time package of this Go version ignores asynctimerchan=1`)
+	}
+	clock := New()
+
+	timer := clock.NewTimer(time.Second)
+	clock.Add(time.Second)
+	if timer.Stop() {
+		t.Error(`Stop() should report an expired timer as inactive under the legacy semantics`)
+	}
+	select {
+	case <-timer.C():
+	default:
+		t.Error(`value should remain in the channel after Stop() under the legacy semantics`)
+	}
+}
+
+func Test_AfterFuncGoroutine(t *testing.T) {
+	clock := New()
+	start := clock.Now()
+
+	var order []string
+	clock.AfterFunc(time.Second, func() {
+		// would deadlock if called while the clock holds its locks
+		clock.AfterFunc(time.Second, func() { order = append(order, "nested") })
+		clock.Sleep(100 * time.Millisecond)
+		order = append(order, "first")
+	})
+	clock.AfterFunc(1200*time.Millisecond, func() { order = append(order, "second") })
+
+	moved := make(chan struct{})
+	clock.AfterFunc(3*time.Second, func() {
+		clock.Add(time.Second)
+		close(moved)
+	})
+	blocked := make(chan struct{})
+	clock.AfterFunc(3*time.Second, func() { <-blocked })
+
+	clock.Add(10 * time.Second)
+	if exp := "first second nested"; strings.Join(order, " ") != exp {
+		t.Errorf(`AfterFunc functions completed out of order: want %q got %q`, exp, strings.Join(order, " "))
+	}
+	select {
+	case <-moved:
+	case <-time.After(time.Second):
+		t.Fatal(`AfterFunc function moving the clock did not complete`)
+	}
+	if d := clock.Now().Sub(start); d != 11*time.Second {
+		t.Errorf(`clock moved by %s, want %s`, d, 11*time.Second)
+	}
+	close(blocked)
+}
+
+func Test_SinceUntil(t *testing.T) {
+	clock := New()
+	start := clock.Now()
+
+	clock.Add(time.Minute)
+	if d := clock.Since(start); d != time.Minute {
+		t.Errorf(`Since() is incorrect: want %s got %s`, time.Minute, d)
+	}
+
+	// stepping the wall time back does not affect elapsed time
+	clock.Set(clock.Now().Add(-time.Hour))
+	clock.Add(30 * time.Second)
+	if d := clock.Since(start); d != 90*time.Second {
+		t.Errorf(`Since() after a backward Set() is incorrect: want %s got %s`, 90*time.Second, d)
+	}
+	if d := clock.Now().Sub(start); d != -time.Hour+90*time.Second {
+		t.Errorf(`wall time is incorrect: want %s got %s`, -time.Hour+90*time.Second, d)
+	}
+
+	deadline := clock.Now().Add(5 * time.Second)
+	if d := clock.Until(deadline); d != 5*time.Second {
+		t.Errorf(`Until() is incorrect: want %s got %s`, 5*time.Second, d)
+	}
+	if d := clock.Until(start); d != -90*time.Second {
+		t.Errorf(`Until() a past reading is incorrect: want %s got %s`, -90*time.Second, d)
+	}
+}
+
+func Test_StepWall(t *testing.T) {
+	clock := New()
+	start := clock.Now()
+
+	timer := clock.NewTimer(5 * time.Second)
+	clock.StepWall(-time.Hour)
+	if exp := start.Add(-time.Hour); !clock.Now().Equal(exp) {
+		t.Errorf(`wall time is incorrect after StepWall(): want %s got %s`, exp, clock.Now())
+	}
+	if p := clock.Pending(); len(p) != 1 || !p[0].Next.Equal(clock.Now().Add(5*time.Second)) {
+		t.Errorf(`pending timer should keep its remaining duration: got %v`, p)
+	}
+
+	clock.Add(4 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal(`timer fired too early after StepWall()`)
+	default:
+	}
+	clock.Add(time.Second)
+	select {
+	case rt := <-timer.C():
+		if exp := start.Add(-time.Hour + 5*time.Second); !rt.Equal(exp) {
+			t.Errorf(`timer time is incorrect: want %s got %s`, exp, rt)
+		}
+	default:
+		t.Fatal(`timer did not fire after its duration elapsed on the monotonic timeline`)
+	}
+	if d := clock.Since(start); d != 5*time.Second {
+		t.Errorf(`Since() is incorrect after StepWall(): want %s got %s`, 5*time.Second, d)
+	}
+}
+
+func Test_AddZero(t *testing.T) {
+	clock := New()
+	timer := clock.NewTimer(0)
+	clock.Add(0)
+	select {
+	case <-timer.C():
+	default:
+		t.Error(`Add(0) should play the events due at the current time`)
+	}
+}
+
+func Test_NegativeDuration(t *testing.T) {
+	clock := New()
+	now := clock.Now()
+
+	timer := clock.NewTimer(-time.Minute)
+	clock.Add(0)
+	select {
+	case v := <-timer.C():
+		if !v.Equal(now) {
+			t.Errorf(`timer with a negative duration delivered %s, want %s`, v, now)
+		}
+	default:
+		t.Fatal(`timer with a negative duration did not fire`)
+	}
+
+	timer.Reset(-time.Minute)
+	clock.Add(time.Second)
+	select {
+	case v := <-timer.C():
+		if !v.Equal(now) {
+			t.Errorf(`timer reset with a negative duration delivered %s, want %s`, v, now)
+		}
+	default:
+		t.Fatal(`timer reset with a negative duration did not fire`)
+	}
+	if d := clock.Since(now); d != time.Second {
+		t.Errorf(`monotonic time is incorrect: want %s got %s`, time.Second, d)
+	}
+}
+
+func Test_SetBackward(t *testing.T) {
+	for _, tc := range []struct {
+		policy BackwardPolicy
+		fire   time.Duration // time after the backward Set when the timer fires
+		tick   time.Duration // time after the backward Set when the ticker ticks
+	}{
+		{BackwardKeepDurations, 6 * time.Second, 3 * time.Second},
+		{BackwardKeepDeadlines, time.Hour + 6*time.Second, time.Hour + 3*time.Second},
+	} {
+		clock := New()
+		clock.SetBackwardPolicy(tc.policy)
+		start := clock.Now()
+		timer := clock.NewTimer(10 * time.Second)
+		ticker := clock.NewTicker(7 * time.Second)
+		clock.Add(4 * time.Second)
+
+		clock.Set(start.Add(4*time.Second - time.Hour))
+		if exp := start.Add(4*time.Second - time.Hour); !clock.Now().Equal(exp) {
+			t.Errorf(`policy %d: wall time is incorrect: want %s got %s`, tc.policy, exp, clock.Now())
+		}
+		if d := clock.Since(start); d != 4*time.Second {
+			t.Errorf(`policy %d: Since() is incorrect: want %s got %s`, tc.policy, 4*time.Second, d)
+		}
+
+		clock.Add(tc.tick - time.Millisecond)
+		clock.Add(time.Millisecond)
+		select {
+		case <-ticker.C():
+		default:
+			t.Errorf(`policy %d: ticker did not tick %s after the backward Set()`, tc.policy, tc.tick)
+		}
+		clock.Add(tc.fire - tc.tick - time.Millisecond)
+		select {
+		case <-timer.C():
+			t.Errorf(`policy %d: timer fired too early`, tc.policy)
+		default:
+		}
+		clock.Add(time.Millisecond)
+		select {
+		case <-timer.C():
+		default:
+			t.Errorf(`policy %d: timer did not fire %s after the backward Set()`, tc.policy, tc.fire)
+		}
+		ticker.Stop()
+	}
+
+	clock := New()
+	clock.SetBackwardPolicy(BackwardReject)
+	start := clock.Now()
+	clock.Add(time.Second)
+	func() {
+		defer func() {
+			if r := recover(); r != ErrBackward {
+				t.Errorf(`Set() backwards should panic with ErrBackward: got %v`, r)
+			}
+		}()
+		clock.Set(start)
+	}()
+	if !clock.Now().Equal(start.Add(time.Second)) {
+		t.Error(`rejected Set() should leave the clock unchanged`)
+	}
+	clock.Add(0)
+	clock.StepWall(-time.Hour)
+	if !clock.Now().Equal(start.Add(time.Second - time.Hour)) {
+		t.Error(`StepWall() should not be subject to the backward policy`)
+	}
+}
+
+func Test_AutoAdvance(t *testing.T) {
+	clock := New()
+	start := clock.Now()
+	stop := clock.AutoAdvance()
+	defer stop()
+
+	done := make(chan time.Duration)
+	go func() {
+		// a retry loop with exponential backoff, over more than 17 minutes
+		var total time.Duration
+		for backoff := time.Second; backoff < 1024*time.Second; backoff *= 2 {
+			clock.Sleep(backoff)
+			total += backoff
+		}
+		done <- total
+	}()
+
+	select {
+	case total := <-done:
+		if d := clock.Since(start); d != total {
+			t.Errorf(`clock moved by %s, want %s`, d, total)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`AutoAdvance() did not move the clock while all goroutines were blocked`)
+	}
+
+	stop()
+	clock.AfterFunc(time.Second, func() {})
+	time.Sleep(10 * time.Millisecond)
+	if d := clock.Since(start); d != 1023*time.Second {
+		t.Errorf(`clock moved after the simulation mode was stopped: %s`, d)
+	}
+}
+
+func Test_AutoAdvanceSyscall(t *testing.T) {
+	// leaves a goroutine of os/signal in a system call
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+
+	clock := New()
+	start := clock.Now()
+	stop := clock.AutoAdvance()
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(time.Hour)
+		close(done)
+	}()
+	select {
+	case <-done:
+		if d := clock.Since(start); d != time.Hour {
+			t.Errorf(`clock moved by %s, want %s`, d, time.Hour)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`AutoAdvance() did not move the clock while a goroutine was in a system call`)
+	}
+}
+
+func Test_AutoAdvanceBusy(t *testing.T) {
+	clock := New(WithSettleTimeout(20 * time.Millisecond))
+	stop := clock.AutoAdvance()
+
+	var quit int32
+	started := make(chan struct{})
+	clock.AfterFunc(time.Second, func() {
+		close(started)
+		for atomic.LoadInt32(&quit) == 0 {
+			runtime.Gosched()
+		}
+	})
+	defer atomic.StoreInt32(&quit, 1)
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`AutoAdvance() did not move the clock`)
+	}
+	busy, ok := stop().(*BusyError)
+	if !ok {
+		t.Fatal(`stop() should return a *BusyError once a goroutine did not settle`)
+	}
+	if len(busy.Goroutines) != 1 {
+		t.Errorf(`unexpected goroutines in the *BusyError: %v`, busy.Goroutines)
+	}
+	if err := stop(); err != busy {
+		t.Errorf(`stop() returned a different error when called again: %v`, err)
+	}
+}
+
+func Test_Go(t *testing.T) {
+	clock := New()
+
+	var count int32
+	clock.Go(func() {
+		for i := 0; i < 3; i++ {
+			clock.Sleep(time.Minute)
+			atomic.AddInt32(&count, 1)
+		}
+	})
+
+	// a goroutine that uses the clock but never parks, which would block the
+	// clock if it were waited for
+	var quit int32
+	spinning := make(chan struct{})
+	go func() {
+		clock.NewTimer(time.Hour)
+		close(spinning)
+		for atomic.LoadInt32(&quit) == 0 {
+			runtime.Gosched()
+		}
+	}()
+	<-spinning
+	defer atomic.StoreInt32(&quit, 1)
+
+	clock.BlockUntil(2, time.Second)
+	clock.Add(3 * time.Minute)
+	if n := atomic.LoadInt32(&count); n != 3 {
+		t.Errorf(`unexpected number of sleeps completed: want %d got %d`, 3, n)
+	}
+}
+
+func Test_WaitIdle(t *testing.T) {
+	clock := New()
+
+	in := make(chan int)
+	var sum int32
+	go func() {
+		timer := clock.NewTimer(time.Hour)
+		for {
+			select {
+			case n := <-in:
+				// busy for a while, without waiting
+				for start := time.Now(); time.Since(start) < 10*time.Millisecond; {
+				}
+				atomic.AddInt32(&sum, int32(n))
+			case <-timer.C():
+				return
+			}
+		}
+	}()
+	clock.BlockUntil(1, time.Second)
+	in <- 3
+	if err := clock.WaitIdle(time.Second); err != nil {
+		t.Fatalf(`unexpected error: %v`, err)
+	}
+	if s := atomic.LoadInt32(&sum); s != 3 {
+		t.Errorf(`unexpected sum: want %d got %d`, 3, s)
+	}
+	clock.Add(time.Hour)
+
+	var quit int32
+	spinning := make(chan struct{})
+	go func() {
+		clock.NewTimer(time.Hour)
+		close(spinning)
+		for atomic.LoadInt32(&quit) == 0 {
+			runtime.Gosched()
+		}
+	}()
+	<-spinning
+	defer atomic.StoreInt32(&quit, 1)
+
+	err := clock.WaitIdle(20 * time.Millisecond)
+	be, ok := err.(*BusyError)
+	if !ok {
+		t.Fatalf(`unexpected error: want *BusyError got %#v`, err)
+	}
+	if len(be.Goroutines) != 1 {
+		t.Errorf(`unexpected number of goroutines still running: want %d got %d`, 1, len(be.Goroutines))
+	}
+	if !strings.Contains(be.Error(), "still running after 20ms") {
+		t.Errorf(`unexpected error message: %q`, be.Error())
+	}
+}
+
+func Test_WaitIdleSyscall(t *testing.T) {
+	// leaves a goroutine of os/signal in a system call
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+
+	clock := New()
+	go clock.Sleep(time.Hour)
+	clock.BlockUntil(1, time.Second)
+	if err := clock.WaitIdle(time.Second); err != nil {
+		t.Errorf(`WaitIdle() should not wait for goroutines in a system call: %v`, err)
+	}
+	clock.Add(time.Hour)
+}
+
+func Test_SettleTimeout(t *testing.T) {
+	clock := New()
+	clock.SetSettleTimeout(20 * time.Millisecond)
+
+	var quit int32
+	defer atomic.StoreInt32(&quit, 1)
+	clock.AfterFunc(time.Second, func() {
+		// never settles
+		for atomic.LoadInt32(&quit) == 0 {
+			runtime.Gosched()
+		}
+	})
+
+	defer func() {
+		r := recover()
+		be, ok := r.(*BusyError)
+		if !ok {
+			t.Fatalf(`unexpected panic value: want *BusyError got %#v`, r)
+		}
+		if len(be.Goroutines) != 1 {
+			t.Fatalf(`unexpected number of goroutines still running: want %d got %d`, 1, len(be.Goroutines))
+		}
+		if !strings.Contains(be.Goroutines[0].Stack, "Test_SettleTimeout") {
+			t.Errorf(`unexpected stack excerpt: %q`, be.Goroutines[0].Stack)
+		}
+		if !strings.Contains(be.Error(), "Test_SettleTimeout") {
+			t.Errorf(`unexpected error message: %q`, be.Error())
+		}
+	}()
+	clock.Add(time.Minute)
+	t.Error(`expected panic`)
+}
+
+func Test_Options(t *testing.T) {
+	epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	clock := New(WithStart(epoch), WithLocation(loc))
+	if now := clock.Now(); !now.Equal(epoch) || now.Location() != loc {
+		t.Errorf(`unexpected start time: want %v got %v`, epoch.In(loc), now)
+	}
+	clock.Set(epoch.Add(time.Hour))
+	if now := clock.Now(); !now.Equal(epoch.Add(time.Hour)) || now.Location() != loc {
+		t.Errorf(`unexpected time after Set(): want %v got %v`, epoch.Add(time.Hour).In(loc), now)
+	}
+
+	clock = New(WithOrdering(OrderLIFO))
+	var order []int
+	for i := 1; i <= 3; i++ {
+		i := i
+		clock.AfterFunc(time.Second, func() { order = append(order, i) })
+	}
+	clock.Add(time.Second)
+	if len(order) != 3 || order[0] != 3 || order[1] != 2 || order[2] != 1 {
+		t.Errorf(`unexpected order of simultaneous events: want %v got %v`, []int{3, 2, 1}, order)
+	}
+
+	clock = New(WithBackwardPolicy(BackwardReject))
+	func() {
+		defer func() {
+			if r := recover(); r != ErrBackward {
+				t.Errorf(`unexpected panic value: want %v got %v`, ErrBackward, r)
+			}
+		}()
+		clock.Add(-time.Second)
+	}()
+
+	clock = New(WithLegacyTimerChan(true))
+	timer := clock.NewTimer(time.Second)
+	clock.Add(time.Second)
+	timer.Stop()
+	select {
+	case <-timer.C():
+	default:
+		t.Error(`value should remain in the channel after Stop() under the legacy semantics`)
+	}
+
+	for _, s := range []WaitStrategy{WaitBackoff, WaitPoll, WaitYield} {
+		clock = New(WithWaitStrategy(s), WithPollInterval(100*time.Microsecond))
+		var count int32
+		go func() {
+			for i := 0; i < 3; i++ {
+				clock.Sleep(time.Second)
+				// busy for a while, without waiting
+				for start := time.Now(); time.Since(start) < time.Millisecond; {
+					runtime.Gosched()
+				}
+				atomic.AddInt32(&count, 1)
+			}
+		}()
+		clock.BlockUntil(1, time.Second)
+		clock.Add(3 * time.Second)
+		if n := atomic.LoadInt32(&count); n != 3 {
+			t.Errorf(`unexpected number of sleeps completed with wait strategy %d: want %d got %d`, s, 3, n)
+		}
+	}
+}
+
+func Test_SimultaneousEvents(t *testing.T) {
+	// play returns the order in which 10 simultaneous events are played.
+	play := func(opts ...Option) []int {
+		clock := New(opts...)
+		var order []int
+		var timers []clocks.Timer
+		for i := 0; i < 10; i++ {
+			i := i
+			timers = append(timers, clock.AfterFunc(time.Duration(10-i)*time.Second, func() { order = append(order, i) }))
+		}
+		// rescheduling keeps the creation order
+		for _, timer := range timers {
+			timer.Reset(10 * time.Second)
+		}
+		clock.Add(10 * time.Second)
+		return order
+	}
+	digits := func(order []int) string {
+		s := ""
+		for _, i := range order {
+			s += strconv.Itoa(i)
+		}
+		return s
+	}
+
+	for run := 0; run < 3; run++ {
+		if order := digits(play()); order != "0123456789" {
+			t.Errorf(`unexpected order of simultaneous events: want %s got %s`, "0123456789", order)
+		}
+	}
+
+	shuffled := digits(play(WithShuffle(42)))
+	if order := digits(play(WithShuffle(42))); order != shuffled {
+		t.Errorf(`unexpected order of simultaneous events with the same seed: want %s got %s`, shuffled, order)
+	}
+	if shuffled == "0123456789" {
+		t.Errorf(`simultaneous events should be shuffled`)
+	}
+	if digits(play(WithShuffle(43))) == shuffled {
+		t.Errorf(`simultaneous events should be shuffled differently with another seed`)
+	}
+	if order := play(WithShuffle(42)); len(order) != 10 {
+		t.Errorf(`unexpected number of events played: want %d got %d`, 10, len(order))
+	} else if sort.Ints(order); digits(order) != "0123456789" {
+		t.Errorf(`unexpected events played: want %s got %s`, "0123456789", digits(order))
+	}
+}
+
+func Test_Segments(t *testing.T) {
+	clock := New()
+	start := clock.Now()
+
+	ticker := clock.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	clock.Add(time.Second)
+	if n := len(clock.(*manualClock).segments); n != 1 {
+		t.Errorf(`unexpected number of segments after playing events: want %d got %d`, 1, n)
+	}
+
+	clock.StepWall(-time.Hour)
+	clock.Add(time.Second)
+	if n := len(clock.(*manualClock).segments); n != 2 {
+		t.Errorf(`unexpected number of segments after a wall time step: want %d got %d`, 2, n)
+	}
+	// a wall time the clock went through, but that was never reported by Now
+	if d := clock.Since(start.Add(500 * time.Millisecond)); d != 1500*time.Millisecond {
+		t.Errorf(`Since() is incorrect for a time before the step: want %s got %s`, 1500*time.Millisecond, d)
+	}
+	if d := clock.Since(start.Add(time.Second - time.Hour)); d != time.Second {
+		t.Errorf(`Since() is incorrect for a time after the step: want %s got %s`, time.Second, d)
+	}
+}
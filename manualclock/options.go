@@ -0,0 +1,137 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manualclock
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Option configures a manual clock created by New.
+type Option func(*manualClock)
+
+// WaitStrategy defines how a manual clock waits for the goroutines woken by an
+// event to settle, before playing the next one.
+type WaitStrategy int
+
+// Strategies for waiting for goroutines to settle.
+const (
+	// WaitBackoff re-checks eagerly at first, since woken goroutines usually settle
+	// quickly, then sleeps between checks, backing off exponentially up to the poll
+	// interval. This is the default.
+	WaitBackoff WaitStrategy = iota
+	// WaitPoll sleeps for the poll interval between checks.
+	WaitPoll
+	// WaitYield never sleeps, only yields the processor between checks. It reacts
+	// the fastest, at the cost of keeping a processor busy while waiting.
+	WaitYield
+)
+
+// Ordering defines the order in which events due at the same time are played.
+// Whichever the ordering, it is the same from one run to the next, as long as the
+// events are created in the same order.
+type Ordering int
+
+// Orderings of simultaneous events.
+const (
+	// OrderFIFO plays the events that were created first first. This is the default.
+	OrderFIFO Ordering = iota
+	// OrderLIFO plays the events that were created last first.
+	OrderLIFO
+	// OrderShuffle plays the events in a pseudo-random order, drawn anew each time
+	// they are scheduled, which helps flush out hidden assumptions about the order
+	// of simultaneous events. The order is reproducible from the seed set with
+	// WithShuffle, 1 by default.
+	OrderShuffle
+)
+
+// DefaultPollInterval is the longest a manual clock sleeps between checks for
+// goroutines to settle, and how often it checks them in the simulation mode,
+// unless changed with WithPollInterval.
+const DefaultPollInterval = time.Millisecond
+
+// WithStart sets the time the clock starts at, instead of the current time.
+func WithStart(t time.Time) Option {
+	return func(mc *manualClock) {
+		mc.now = t
+	}
+}
+
+// WithLocation sets the location of the times reported by the clock, whichever
+// location the times it is set to are in.
+func WithLocation(loc *time.Location) Option {
+	return func(mc *manualClock) {
+		mc.loc = loc
+	}
+}
+
+// WithWaitStrategy selects how the clock waits for the goroutines woken by an
+// event to settle. Inside a testing/synctest bubble, the clock always uses WaitYield.
+func WithWaitStrategy(s WaitStrategy) Option {
+	return func(mc *manualClock) {
+		mc.strategy = s
+	}
+}
+
+// WithPollInterval sets the longest the clock sleeps between checks for goroutines
+// to settle, and how often it checks them in the simulation mode.
+func WithPollInterval(d time.Duration) Option {
+	return func(mc *manualClock) {
+		if d > 0 {
+			mc.interval = d
+		}
+	}
+}
+
+// WithBackwardPolicy selects what happens when the clock is set to an earlier time.
+func WithBackwardPolicy(p BackwardPolicy) Option {
+	return func(mc *manualClock) {
+		mc.backward = p
+	}
+}
+
+// WithSettleTimeout sets how much real time the goroutines woken by each event
+// are given to settle, when the clock moves. A non-positive timeout waits indefinitely.
+func WithSettleTimeout(d time.Duration) Option {
+	return func(mc *manualClock) {
+		mc.settle = d
+	}
+}
+
+// WithLegacyTimerChan selects the channel semantics of timers and tickers: the
+// legacy ones if true, where a stale value may be received after Stop or Reset,
+// or the ones of the time package as of Go 1.23 otherwise. It takes precedence
+// over the semantics followed by the timers of the time package.
+func WithLegacyTimerChan(legacy bool) Option {
+	return func(mc *manualClock) {
+		mc.legacy = legacy
+	}
+}
+
+// WithOrdering selects the order in which events due at the same time are played.
+func WithOrdering(o Ordering) Option {
+	return func(mc *manualClock) {
+		mc.order = o
+	}
+}
+
+// WithShuffle selects the OrderShuffle ordering of simultaneous events, seeded
+// with the provided value.
+func WithShuffle(seed int64) Option {
+	return func(mc *manualClock) {
+		mc.order = OrderShuffle
+		mc.shuffle = rand.New(rand.NewSource(seed))
+	}
+}
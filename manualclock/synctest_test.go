@@ -0,0 +1,112 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.25
+
+package manualclock
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func Test_Synctest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		clock := New()
+		start := clock.Now()
+
+		ticks := make(chan time.Duration, 10)
+		go func() {
+			for i := 0; i < 3; i++ {
+				clock.Sleep(time.Minute)
+				ticks <- clock.Since(start)
+			}
+		}()
+		clock.BlockUntil(1, 0)
+
+		// an AfterFunc function blocked on the clock's own lock is not durably
+		// blocked, so waiting for it must not rely on the fake time
+		clock.AfterFunc(30*time.Second, func() { clock.Add(0) })
+
+		clock.Add(3 * time.Minute)
+		if len(ticks) != 3 {
+			t.Fatalf(`unexpected number of sleeps completed: want %d got %d`, 3, len(ticks))
+		}
+		for i := 1; i <= 3; i++ {
+			if d := <-ticks; d != time.Duration(i)*time.Minute {
+				t.Errorf(`sleep %d ended at the wrong time: want %s got %s`, i, time.Duration(i)*time.Minute, d)
+			}
+		}
+
+		// a goroutine that stays busy for a while, then blocks on a mutex, which is
+		// not durable blocking either
+		var mu sync.Mutex
+		quit := make(chan struct{})
+		go func() {
+			ticker := clock.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C():
+				case <-quit:
+					return
+				}
+				for i := 0; i < 1000; i++ {
+					runtime.Gosched()
+				}
+				mu.Lock()
+				mu.Unlock()
+			}
+		}()
+		clock.BlockUntil(1, 0)
+		mu.Lock()
+		clock.Add(time.Minute)
+		mu.Unlock()
+		close(quit)
+
+		stop := clock.AutoAdvance()
+		defer stop()
+		clock.Sleep(time.Hour)
+		if d := clock.Since(start); d != time.Hour+4*time.Minute {
+			t.Errorf(`AutoAdvance() in a bubble moved the clock to the wrong time: got %s`, d)
+		}
+	})
+}
+
+func Test_SynctestSettleTimeout(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		clock := New(WithSettleTimeout(20 * time.Millisecond))
+
+		var quit int32
+		defer atomic.StoreInt32(&quit, 1)
+		clock.AfterFunc(time.Second, func() {
+			// never settles
+			for atomic.LoadInt32(&quit) == 0 {
+				runtime.Gosched()
+			}
+		})
+
+		defer func() {
+			if _, ok := recover().(*BusyError); !ok {
+				t.Error(`expected a *BusyError panic`)
+			}
+		}()
+		clock.Add(time.Minute)
+		t.Error(`expected panic`)
+	})
+}
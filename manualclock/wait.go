@@ -17,30 +17,224 @@ package manualclock
 import (
 	"bytes"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 // nonwaiting represents the set of goroutine statuses that do not indicate waiting.
+// Goroutines in a system call count as waiting: they are usually blocked outside
+// the process, e.g. the one delivering signals for os/signal, and never on the clock.
 var nonwaiting = map[string]struct{}{
 	"idle":      {},
 	"runnable":  {},
 	"running":   {},
-	"syscall":   {},
 	"dead":      {},
 	"enqueue":   {},
 	"copystack": {},
 }
 
+const (
+	// spins is the number of times a waitpoint re-checks goroutine status, only
+	// yielding the processor in between, before it starts sleeping.
+	spins = 16
+
+	// bubbleChecks is the number of checks of goroutine status after which a
+	// waitpoint gives up in a testing/synctest bubble, where time.Now only reports
+	// the fake time, whatever the timeout. Each check dumps the stacks of all
+	// goroutines, so it is kept much lower than the checks a timeout would allow.
+	bubbleChecks = 1000
+
+	// stackFrames is the number of frames in the stack excerpts of BusyError.
+	stackFrames = 8
+)
+
+// goid returns the id of the calling goroutine, as it appears in stack traces.
+func goid() string {
+	var buf [64]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	if p := bytes.IndexByte(b, ' '); p > 0 {
+		return string(b[:p])
+	}
+	return ""
+}
+
+// inBubble reports whether the calling goroutine runs in a testing/synctest
+// bubble, as it appears in its stack trace header.
+func inBubble() bool {
+	var buf [128]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	if p := bytes.IndexByte(b, '\n'); p >= 0 {
+		b = b[:p]
+	}
+	return bytes.Contains(b, []byte("synctest bubble"))
+}
+
+// tracker keeps the set of goroutines that depend on a clock. By default, all
+// goroutines are considered dependent, as any of them may receive a clock event,
+// e.g. on a channel created by another goroutine.
+//
+// Once in explicit mode, only the goroutines launched through the clock, including
+// the ones running AfterFunc functions, are considered dependent.
+type tracker struct {
+	ids      map[string]struct{}
+	explicit bool
+	mu       sync.Mutex
+}
+
+// Add adds the goroutine with the provided id to the set of dependent goroutines.
+func (tr *tracker) Add(id string) {
+	tr.mu.Lock()
+	if tr.ids == nil {
+		tr.ids = map[string]struct{}{}
+	}
+	tr.ids[id] = struct{}{}
+	tr.mu.Unlock()
+}
+
+// Explicit switches the tracker to explicit mode.
+func (tr *tracker) Explicit() {
+	tr.mu.Lock()
+	tr.explicit = true
+	tr.mu.Unlock()
+}
+
+// Untrack removes the goroutine with the provided id from the set of dependent
+// goroutines.
+func (tr *tracker) Untrack(id string) {
+	tr.mu.Lock()
+	delete(tr.ids, id)
+	tr.mu.Unlock()
+}
+
+// Others reports whether any goroutine other than the one with the provided id
+// may depend on the clock.
+func (tr *tracker) Others(id string) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if !tr.explicit {
+		return true
+	}
+	_, found := tr.ids[id]
+	return len(tr.ids) > 1 || len(tr.ids) == 1 && !found
+}
+
+// dependent returns the dependent goroutines other than the one with the provided
+// id, according to the provided status map. In explicit mode, goroutines that no
+// longer exist are forgotten. The caller must hold the mutex.
+func (tr *tracker) dependent(grs map[string]string, except string) map[string]string {
+	if !tr.explicit {
+		deps := make(map[string]string, len(grs))
+		for g, s := range grs {
+			if g != except {
+				deps[g] = s
+			}
+		}
+		return deps
+	}
+	deps := make(map[string]string, len(tr.ids))
+	for g := range tr.ids {
+		s, found := grs[g]
+		if !found {
+			delete(tr.ids, g)
+			continue
+		}
+		if g != except {
+			deps[g] = s
+		}
+	}
+	return deps
+}
+
+// waiting returns the dependent goroutines other than the one with the provided
+// id that are currently waiting, according to the provided status map.
+func (tr *tracker) waiting(grs map[string]string, except string) map[string]struct{} {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	watch := map[string]struct{}{}
+	for g, s := range tr.dependent(grs, except) {
+		if _, found := nonwaiting[s]; !found {
+			watch[g] = struct{}{}
+		}
+	}
+	return watch
+}
+
+// all returns all the dependent goroutines other than the one with the provided
+// id, according to the provided status map.
+func (tr *tracker) all(grs map[string]string, except string) map[string]struct{} {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	watch := map[string]struct{}{}
+	for g := range tr.dependent(grs, except) {
+		watch[g] = struct{}{}
+	}
+	return watch
+}
+
+// idle reports whether all the dependent goroutines other than the one with the
+// provided id are waiting, according to the provided status map.
+func (tr *tracker) idle(grs map[string]string, except string) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, s := range tr.dependent(grs, except) {
+		if _, found := nonwaiting[s]; found {
+			return false
+		}
+	}
+	return true
+}
+
+// Goroutine identifies a goroutine that depends on a manual clock.
+type Goroutine struct {
+	ID     string // goroutine id, as it appears in stack traces
+	Status string // status, as it appears in stack traces, e.g. "running"
+	Stack  string // excerpt of the stack trace, without the header line
+}
+
+// BusyError reports the goroutines depending on a manual clock that did not
+// settle within the allotted time.
+type BusyError struct {
+	Timeout    time.Duration // real time allotted
+	Goroutines []Goroutine   // goroutines still running
+}
+
+func (e *BusyError) Error() string {
+	s := "manualclock: " + strconv.Itoa(len(e.Goroutines)) + " goroutine(s) still running after " + e.Timeout.String() + ":"
+	for _, g := range e.Goroutines {
+		s += "\n\tgoroutine " + g.ID + " [" + g.Status + "]"
+		if g.Stack != "" {
+			s += "\n\t\t" + strings.Replace(g.Stack, "\n", "\n\t\t", -1)
+		}
+	}
+	return s
+}
+
 type waitpoint struct {
-	watch map[string]struct{}
-	buf   []byte
+	tracker  *tracker
+	self     string // id of the goroutine moving the clock, which is never waited for
+	bubble   bool   // whether that goroutine runs in a testing/synctest bubble
+	strategy WaitStrategy
+	interval time.Duration       // longest pause between consecutive checks
+	waiting  map[string]struct{} // dependent goroutines waiting before the event, any of which it may wake
+	stale    bool                // whether goroutines were woken since `waiting` was recorded
+	watch    map[string]struct{}
+	done     map[string]chan struct{} // closed when the goroutines started by Go return
+	buf      []byte
 }
 
-func newWaitpoint() *waitpoint {
+func newWaitpoint(tr *tracker, strategy WaitStrategy, interval time.Duration) *waitpoint {
 	w := &waitpoint{
-		buf: make([]byte, 1024),
+		tracker:  tr,
+		strategy: strategy,
+		interval: interval,
+		self:     goid(),
+		bubble:   inBubble(),
+		buf:      make([]byte, 1024),
+		stale:    true,
 	}
-	w.Reset()
 	return w
 }
 
@@ -74,30 +268,201 @@ func (wp *waitpoint) grStatus() map[string]string {
 	}
 }
 
+// stacks returns an excerpt of the stack trace of each of the provided goroutines,
+// up to stackFrames frames.
+func (wp *waitpoint) stacks(ids map[string]struct{}) map[string]string {
+	n := runtime.Stack(wp.buf, true)
+	for n == len(wp.buf) {
+		wp.buf = make([]byte, 2*len(wp.buf))
+		n = runtime.Stack(wp.buf, true)
+	}
+	stacks := map[string]string{}
+	for _, block := range bytes.Split(wp.buf[:n], []byte("\n\n")) {
+		// the first line is like "goroutine 33 [running]:", followed by two lines per frame
+		lines := bytes.Split(bytes.TrimSpace(block), []byte{'\n'})
+		g := bytes.TrimPrefix(lines[0], []byte("goroutine "))
+		p := bytes.IndexByte(g, ' ')
+		if len(g) == len(lines[0]) || p < 0 {
+			// unexpected format; ignore
+			continue
+		}
+		if _, found := ids[string(g[:p])]; !found {
+			continue
+		}
+		lines = lines[1:]
+		if len(lines) > 2*stackFrames {
+			lines = append(lines[:2*stackFrames:2*stackFrames], []byte("..."))
+		}
+		stacks[string(g[:p])] = string(bytes.Join(lines, []byte{'\n'}))
+	}
+	return stacks
+}
+
+// Reset stops watching goroutines, before the next event.
 func (wp *waitpoint) Reset() {
+	if wp.watch != nil {
+		wp.stale = true
+	}
+	wp.watch = nil
+	wp.done = nil
+}
+
+// Snapshot records the dependent goroutines that are currently waiting. These are
+// the ones that may be woken by sending the next event on its channel. As long as
+// the clock wakes no goroutine, the previous record is kept, so that the cost of
+// events that wake none does not depend on the number of goroutines.
+func (wp *waitpoint) Snapshot() {
+	if !wp.stale {
+		return
+	}
+	wp.stale = false
+	wp.waiting = nil
+	if wp.tracker.Others(wp.self) {
+		wp.waiting = wp.tracker.waiting(wp.grStatus(), wp.self)
+	}
+}
+
+// Woken watches the goroutines recorded by Snapshot, once the event was received
+// by one of them.
+func (wp *waitpoint) Woken() {
+	wp.watch = make(map[string]struct{}, len(wp.waiting))
+	for g := range wp.waiting {
+		wp.watch[g] = struct{}{}
+	}
+}
+
+// WatchAll watches all the dependent goroutines, rather than only the waiting ones.
+func (wp *waitpoint) WatchAll() {
+	wp.watch = wp.tracker.all(wp.grStatus(), wp.self)
+	wp.done = nil
+}
+
+// Go calls f in a new goroutine, which depends on the clock, and adds it to the
+// watched goroutines. Wait then returns once f returns or waits.
+func (wp *waitpoint) Go(f func()) {
+	started := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g := goid()
+		wp.tracker.Add(g)
+		defer wp.tracker.Untrack(g)
+		started <- g
+		f()
+	}()
+	g := <-started
+	if wp.watch == nil {
+		wp.watch = map[string]struct{}{}
+	}
+	if wp.done == nil {
+		wp.done = map[string]chan struct{}{}
+	}
+	wp.watch[g] = struct{}{}
+	wp.done[g] = done
+}
+
+// returned stops watching the goroutines started by Go that have returned,
+// and reports whether any goroutine is still watched. Receiving from the closed
+// channels also makes the effects of these goroutines visible to the caller.
+func (wp *waitpoint) returned() bool {
+	for g, done := range wp.done {
+		select {
+		case <-done:
+			delete(wp.watch, g)
+			delete(wp.done, g)
+		default:
+		}
+	}
+	return len(wp.watch) > 0
+}
+
+// busy reports whether any of the watched goroutines is not waiting.
+func (wp *waitpoint) busy() bool {
+	if !wp.returned() {
+		return false
+	}
 	grs := wp.grStatus()
-	// fmt.Println(grs, "\n-----\n")
-	wp.watch = make(map[string]struct{}, len(grs))
-	for g, s := range grs {
-		if _, found := nonwaiting[s]; !found {
-			wp.watch[g] = struct{}{}
+	for g := range wp.watch {
+		if s, found := grs[g]; found {
+			if _, found := nonwaiting[s]; found {
+				return true
+			}
 		}
 	}
+	return false
 }
 
-func (wp *waitpoint) Wait() {
-	for func /*busy*/ () bool {
-		grs := wp.grStatus()
-		for g := range wp.watch {
-			if s, found := grs[g]; found {
-				if _, found := nonwaiting[s]; found {
-					return true
-				}
+// running returns the watched goroutines that are not waiting, in the order they
+// were created.
+func (wp *waitpoint) running() []Goroutine {
+	var running []Goroutine
+	ids := map[string]struct{}{}
+	grs := wp.grStatus()
+	for g := range wp.watch {
+		if s, found := grs[g]; found {
+			if _, found := nonwaiting[s]; found {
+				running = append(running, Goroutine{ID: g, Status: s})
+				ids[g] = struct{}{}
 			}
 		}
-		// fmt.Println(grs, "\n-----\n")
-		return false
-	}() {
-		time.Sleep(time.Millisecond)
 	}
+	stacks := wp.stacks(ids)
+	for i := range running {
+		running[i].Stack = stacks[running[i].ID]
+	}
+	sort.Slice(running, func(i, j int) bool {
+		if len(running[i].ID) != len(running[j].ID) {
+			return len(running[i].ID) < len(running[j].ID)
+		}
+		return running[i].ID < running[j].ID
+	})
+	return running
+}
+
+// Wait blocks until all the watched goroutines are waiting again, re-checking
+// according to the wait strategy. In a testing/synctest bubble it never sleeps,
+// only yields the processor between checks.
+//
+// If timeout is positive, Wait gives up after that much real time has elapsed,
+// and returns a *BusyError listing the goroutines still running. In a bubble,
+// a positive timeout only enables the limit: Wait gives up after bubbleChecks
+// checks instead.
+func (wp *waitpoint) Wait(timeout time.Duration) error {
+	if len(wp.watch) == 0 {
+		return nil
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if len(wp.done) > 0 {
+		// give the goroutines started by Go a chance to return
+		runtime.Gosched()
+	}
+	pause := max(wp.interval/spins, 1)
+	if wp.strategy == WaitPoll {
+		pause = wp.interval
+	}
+	for i := 0; wp.busy(); i++ {
+		if i < spins && wp.strategy == WaitBackoff {
+			continue
+		}
+		if timeout > 0 && (wp.bubble && i >= bubbleChecks || !wp.bubble && !time.Now().Before(deadline)) {
+			if running := wp.running(); len(running) > 0 {
+				return &BusyError{Timeout: timeout, Goroutines: running}
+			}
+			return nil
+		}
+		if wp.bubble || wp.strategy == WaitYield {
+			// In a synctest bubble, sleeping would wait for the fake time to advance,
+			// which only happens once every goroutine in the bubble is blocked.
+			runtime.Gosched()
+			continue
+		}
+		time.Sleep(pause)
+		if pause < wp.interval {
+			pause = min(2*pause, wp.interval)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,180 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clocks
+
+import (
+	"sync"
+	"time"
+
+	"github.com/agext/clocks/internal/chantimer"
+)
+
+// NewOffset returns a live Clock that reports the current time shifted by the
+// provided offset. Unlike on the live clock returned by New, Add and Set are
+// effective: they change the offset. Timers and tickers keep running in real time,
+// so pending ones fire after the correct elapsed duration even if the offset
+// changes in the meantime; the times they deliver include the offset.
+func NewOffset(offset time.Duration) Clock {
+	return &offsetClock{offset: offset}
+}
+
+// offsetClock represents a live clock shifted by an adjustable offset.
+type offsetClock struct {
+	offset time.Duration // difference from real time
+	mu     sync.RWMutex  // protection for `offset`
+}
+
+// Add moves the offset clock by the specified duration.
+func (oc *offsetClock) Add(d time.Duration) {
+	oc.mu.Lock()
+	oc.offset += d
+	oc.mu.Unlock()
+}
+
+// Set moves the offset clock to the specified time.
+func (oc *offsetClock) Set(t time.Time) {
+	oc.mu.Lock()
+	oc.offset = t.Sub(time.Now())
+	oc.mu.Unlock()
+}
+
+// Now returns the current time on the offset clock.
+func (oc *offsetClock) Now() time.Time {
+	return time.Now().Add(oc.Offset())
+}
+
+// Offset returns the current difference from real time.
+func (oc *offsetClock) Offset() time.Duration {
+	oc.mu.RLock()
+	defer oc.mu.RUnlock()
+	return oc.offset
+}
+
+// Since returns the time elapsed since t on the offset clock, which includes any
+// change of the offset in the meantime.
+func (oc *offsetClock) Since(t time.Time) time.Duration {
+	return oc.Now().Sub(t)
+}
+
+// Until returns the duration until t.
+func (oc *offsetClock) Until(t time.Time) time.Duration {
+	return t.Sub(oc.Now())
+}
+
+// Sleep is a pass-through wrapper around time.Sleep
+func (*offsetClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// After waits for the duration to elapse and then sends the current time on the
+// offset clock on the returned channel.
+func (oc *offsetClock) After(d time.Duration) <-chan time.Time {
+	return oc.NewTimer(d).C()
+}
+
+// AfterFunc wraps the result of time.AfterFunc in a type that satisfies the Timer interface.
+func (*offsetClock) AfterFunc(d time.Duration, f func()) Timer {
+	return liveTimer{time.AfterFunc(d, f)}
+}
+
+// NewTimer returns a new Timer that sends the current time on the offset clock
+// on its channel after the duration elapses.
+func (oc *offsetClock) NewTimer(d time.Duration) Timer {
+	return chantimer.New(realAfterFunc, oc.Now, nil, d)
+}
+
+// realAfterFunc starts the real timers behind the timers of the offset clock.
+func realAfterFunc(d time.Duration, f func()) chantimer.Stopper {
+	return time.AfterFunc(d, f)
+}
+
+// Tick is a convenience wrapper for NewTicker providing access to the ticking
+// channel only. It returns nil if d <= 0.
+func (oc *offsetClock) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return oc.NewTicker(d).C()
+}
+
+// NewTicker returns a new Ticker that sends the current time on the offset clock
+// on its channel with a period of d. It panics if d <= 0.
+func (oc *offsetClock) NewTicker(d time.Duration) Ticker {
+	t := &offsetTicker{
+		Ticker: time.NewTicker(d),
+		clock:  oc,
+		c:      make(chan time.Time, 1),
+	}
+	t.start()
+	return t
+}
+
+// offsetTicker is a real ticker delivering times on an offset clock.
+type offsetTicker struct {
+	*time.Ticker
+	clock *offsetClock
+	c     chan time.Time
+	done  chan struct{} // closed to stop relaying ticks; nil while stopped
+	mu    sync.Mutex    // protection for `done`
+}
+
+func (t *offsetTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *offsetTicker) Stop() {
+	t.Ticker.Stop()
+	t.mu.Lock()
+	if t.done != nil {
+		close(t.done)
+		t.done = nil
+	}
+	chantimer.Drain(t.c)
+	t.mu.Unlock()
+}
+
+func (t *offsetTicker) Reset(d time.Duration) {
+	t.Stop()
+	t.Ticker.Reset(d)
+	t.start()
+}
+
+// start relays the ticks of the real ticker, unless already relaying.
+func (t *offsetTicker) start() {
+	t.mu.Lock()
+	if t.done == nil {
+		t.done = make(chan struct{})
+		go t.relay(t.done)
+	}
+	t.mu.Unlock()
+}
+
+// relay forwards the ticks of the real ticker, shifted by the clock offset,
+// until done is closed.
+func (t *offsetTicker) relay(done chan struct{}) {
+	for {
+		select {
+		case rt := <-t.Ticker.C:
+			t.mu.Lock()
+			if t.done == done {
+				select {
+				case t.c <- rt.Add(t.clock.Offset()):
+				default:
+				}
+			}
+			t.mu.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clocks
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_NewOffset(t *testing.T) {
+	clock := NewOffset(time.Hour)
+
+	if off := clock.Now().Sub(time.Now()); off < time.Hour-time.Second || off > time.Hour {
+		t.Errorf(`Now() is incorrect: want offset %s got %s`, time.Hour, off)
+	}
+
+	timer := clock.NewTimer(50 * time.Millisecond)
+	ticker := clock.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	clock.Add(time.Hour)
+	if off := clock.Now().Sub(time.Now()); off < 2*time.Hour-time.Second || off > 2*time.Hour {
+		t.Errorf(`Add() is incorrect: want offset %s got %s`, 2*time.Hour, off)
+	}
+
+	select {
+	case rt := <-ticker.C():
+		if off := rt.Sub(time.Now()); off < 2*time.Hour-time.Second || off > 2*time.Hour {
+			t.Errorf(`tick time is incorrect: want offset %s got %s`, 2*time.Hour, off)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error(`NewTicker() is taking too long - the clock may not be live`)
+	}
+
+	epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock.Set(epoch)
+	if off := clock.Now().Sub(epoch); off < 0 || off > time.Second {
+		t.Errorf(`Set() is incorrect: want %s got %s`, epoch, clock.Now())
+	}
+
+	select {
+	case rt := <-timer.C():
+		if off := rt.Sub(epoch); off < 0 || off > time.Second {
+			t.Errorf(`timer time is incorrect: want %s got %s`, epoch, rt)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error(`pending timer did not fire after the offset changed`)
+	}
+
+	if timer.Stop() {
+		t.Error(`Stop() on an expired timer should return false`)
+	}
+
+	ticker.Stop()
+	ticker.Reset(10 * time.Millisecond)
+	select {
+	case <-ticker.C():
+	case <-time.After(100 * time.Millisecond):
+		t.Error(`Reset() did not reactivate a stopped ticker`)
+	}
+}
+
+func Test_OffsetTimerReset(t *testing.T) {
+	clock := NewOffset(time.Hour)
+
+	timer := clock.NewTimer(time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if !timer.Reset(time.Hour) {
+		t.Error(`Reset() should report an expired timer whose value was not received as active`)
+	}
+	select {
+	case <-timer.C():
+		t.Error(`stale value received after Reset()`)
+	default:
+	}
+	timer.Stop()
+}
+
+func Test_OffsetSince(t *testing.T) {
+	clock := NewOffset(0)
+	start := clock.Now()
+
+	clock.Add(time.Hour)
+	if d := clock.Since(start); d < time.Hour || d > time.Hour+time.Second {
+		t.Errorf(`Since() should include offset changes: want %s got %s`, time.Hour, d)
+	}
+	if d := clock.Until(start.Add(time.Minute)); d < -time.Hour+time.Minute-time.Second || d > -time.Hour+time.Minute {
+		t.Errorf(`Until() should include offset changes: want %s got %s`, -time.Hour+time.Minute, d)
+	}
+}
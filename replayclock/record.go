@@ -0,0 +1,282 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replayclock
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/agext/clocks"
+	"github.com/agext/clocks/internal/chantimer"
+)
+
+// Recorder is a clock that records its interaction with the program.
+type Recorder interface {
+	clocks.Clock
+
+	// Err returns the first error encountered while writing the recording, if any.
+	Err() error
+}
+
+// NewRecorder returns a clock that passes all calls through to c, and writes
+// an Entry describing each interaction to w, as a line of JSON.
+func NewRecorder(c clocks.Clock, w io.Writer) Recorder {
+	return &recorder{
+		clock: c,
+		enc:   json.NewEncoder(w),
+	}
+}
+
+// recorder represents a clock that records all calls to another clock.
+type recorder struct {
+	clock  clocks.Clock  // the recorded clock
+	enc    *json.Encoder // encoder writing the recording
+	lastID int           // id of the most recently created event
+	err    error         // first error encountered by the encoder
+	mu     sync.Mutex    // protection for all the above, except `clock`
+}
+
+// log writes the entry to the recording.
+func (r *recorder) log(e Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(e); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// create logs the creation of a new event, returning its id.
+func (r *recorder) create(op string, d time.Duration) int {
+	r.mu.Lock()
+	r.lastID++
+	id := r.lastID
+	r.mu.Unlock()
+	r.log(Entry{Op: op, T: r.clock.Now(), ID: id, D: d})
+	return id
+}
+
+// Err returns the first error encountered while writing the recording, if any.
+func (r *recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Add moves the recorded clock by the specified duration.
+func (r *recorder) Add(d time.Duration) {
+	r.clock.Add(d)
+	r.log(Entry{Op: OpAdd, T: r.clock.Now(), D: d})
+}
+
+// Set moves the recorded clock to the specified time.
+func (r *recorder) Set(t time.Time) {
+	r.clock.Set(t)
+	r.log(Entry{Op: OpSet, T: r.clock.Now()})
+}
+
+// Now returns the current time on the recorded clock.
+func (r *recorder) Now() time.Time {
+	now := r.clock.Now()
+	r.log(Entry{Op: OpNow, T: now})
+	return now
+}
+
+// Since returns the time elapsed since t on the recorded clock. It is based on
+// Now, so it is recorded as a Now call.
+func (r *recorder) Since(t time.Time) time.Duration {
+	return r.Now().Sub(t)
+}
+
+// Until returns the duration until t on the recorded clock. It is based on Now,
+// so it is recorded as a Now call.
+func (r *recorder) Until(t time.Time) time.Duration {
+	return t.Sub(r.Now())
+}
+
+// Sleep pauses the current goroutine for the given duration on the recorded clock.
+// A zero or negative duration causes Sleep to return immediately.
+func (r *recorder) Sleep(d time.Duration) {
+	if d <= 0 {
+		r.create(OpSleep, d)
+		return
+	}
+	<-r.newTimer(OpSleep, d, nil).C()
+}
+
+// After waits for the duration to elapse on the recorded clock and then sends
+// the current time on the returned channel.
+func (r *recorder) After(d time.Duration) <-chan time.Time {
+	return r.NewTimer(d).C()
+}
+
+// AfterFunc waits for the duration to elapse on the recorded clock and then
+// executes a function.
+func (r *recorder) AfterFunc(d time.Duration, f func()) clocks.Timer {
+	return r.newTimer(OpAfterFunc, d, f)
+}
+
+// NewTimer returns a new Timer on the recorded clock.
+func (r *recorder) NewTimer(d time.Duration) clocks.Timer {
+	return r.newTimer(OpTimer, d, nil)
+}
+
+// Tick is a convenience wrapper for NewTicker providing access to the ticking
+// channel only. It returns nil if d <= 0.
+func (r *recorder) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return r.NewTicker(d).C()
+}
+
+// NewTicker returns a new Ticker on the recorded clock. It panics if d <= 0.
+func (r *recorder) NewTicker(d time.Duration) clocks.Ticker {
+	if d <= 0 {
+		panic("replayclock: non-positive interval for NewTicker")
+	}
+	t := &ticker{
+		r:  r,
+		id: r.create(OpTicker, d),
+		c:  make(chan time.Time, 1),
+	}
+	t.mu.Lock()
+	t.start(r.clock.Now(), d)
+	t.mu.Unlock()
+	return t
+}
+
+// newTimer returns a new timer on the recorded clock. All timers, including
+// those behind Sleep and After, are built on AfterFunc, so their firing can be
+// recorded without relaying their channels.
+func (r *recorder) newTimer(op string, d time.Duration, f func()) *timer {
+	t := &timer{
+		r:  r,
+		id: r.create(op, d),
+	}
+	t.Timer = chantimer.New(r.afterFunc, t.fire, f, d)
+	return t
+}
+
+// afterFunc starts the timers on the recorded clock behind the recorded timers.
+func (r *recorder) afterFunc(d time.Duration, f func()) chantimer.Stopper {
+	return r.clock.AfterFunc(d, f)
+}
+
+// timer is a recorded timer.
+type timer struct {
+	*chantimer.Timer
+	r  *recorder
+	id int
+}
+
+// fire records the firing of the timer, and returns the current time.
+func (t *timer) fire() time.Time {
+	now := t.r.clock.Now()
+	t.r.log(Entry{Op: OpFire, T: now, ID: t.id})
+	return now
+}
+
+// Stop turns off the timer, discarding a value that was not received yet.
+func (t *timer) Stop() bool {
+	ok := t.Timer.Stop()
+	t.r.log(Entry{Op: OpStop, T: t.r.clock.Now(), ID: t.id, OK: ok})
+	return ok
+}
+
+// Reset changes the expiry time of the timer, and reactivates it if it was stopped.
+// As with Stop, a value that was not received yet is discarded.
+func (t *timer) Reset(d time.Duration) bool {
+	ok := t.Timer.Reset(d)
+	t.r.log(Entry{Op: OpReset, T: t.r.clock.Now(), ID: t.id, D: d, OK: ok})
+	return ok
+}
+
+// ticker is a recorded ticker. It is built on a self-rearming AfterFunc timer,
+// so its ticks can be recorded without relaying its channel.
+type ticker struct {
+	r    *recorder
+	id   int
+	c    chan time.Time
+	d    time.Duration // time between ticks
+	next time.Time     // next tick time
+	t    clocks.Timer  // timer for the next tick, on the recorded clock
+	gen  int           // incremented when `t` is replaced or stopped
+	mu   sync.Mutex    // protection for all the above, and for sending on `c`
+}
+
+// start starts a new timer on the recorded clock, for the first tick after
+// now. The caller must hold the mutex.
+func (t *ticker) start(now time.Time, d time.Duration) {
+	t.d = d
+	t.next = now.Add(d)
+	t.gen++
+	gen := t.gen
+	t.t = t.r.clock.AfterFunc(d, func() { t.tick(gen) })
+}
+
+// tick records a tick, sends the current time on the ticker channel, and
+// schedules the next tick, skipping the ones that are already late. Nothing
+// happens if the ticker was reset or stopped in the meantime.
+func (t *ticker) tick(gen int) {
+	now := t.r.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if gen != t.gen {
+		return
+	}
+	t.next = t.next.Add(t.d)
+	if !t.next.After(now) {
+		t.next = now.Add(t.d - now.Sub(t.next)%t.d)
+	}
+	t.t.Reset(t.next.Sub(now))
+
+	t.r.log(Entry{Op: OpFire, T: now, ID: t.id})
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+// C returns the tick channel
+func (t *ticker) C() <-chan time.Time {
+	return t.c
+}
+
+// Reset stops the ticker and resets its period to the specified duration, then
+// reactivates it. It panics if d <= 0.
+func (t *ticker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("replayclock: non-positive interval for Ticker.Reset")
+	}
+	now := t.r.clock.Now()
+	t.mu.Lock()
+	t.t.Stop()
+	chantimer.Drain(t.c)
+	t.start(now, d)
+	t.mu.Unlock()
+	t.r.log(Entry{Op: OpReset, T: now, ID: t.id, D: d})
+}
+
+// Stop turns off the ticker, discarding any tick that was not received yet.
+func (t *ticker) Stop() {
+	t.mu.Lock()
+	t.t.Stop()
+	chantimer.Drain(t.c)
+	t.gen++
+	t.mu.Unlock()
+	t.r.log(Entry{Op: OpStop, T: t.r.clock.Now(), ID: t.id})
+}
@@ -0,0 +1,329 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replayclock records the interaction of a program with a clock, and
+// replays it deterministically.
+//
+// A recorder wraps any clocks.Clock and writes every Now result, every timer,
+// ticker and sleep creation, firing, Stop and Reset to a stream, as JSON lines.
+// A replay clock reads such a stream and feeds the recorded values back in order,
+// on top of a manual clock that is only moved to the recorded times.
+package replayclock
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/agext/clocks"
+	"github.com/agext/clocks/manualclock"
+)
+
+// Operations recorded in an Entry.
+const (
+	OpNow       = "now"       // Now was called; T is the returned time
+	OpAdd       = "add"       // Add was called; T is the clock time afterwards
+	OpSet       = "set"       // Set was called; T is the clock time afterwards
+	OpSleep     = "sleep"     // Sleep was called
+	OpTimer     = "timer"     // a timer was created, by NewTimer or After
+	OpAfterFunc = "afterfunc" // a timer was created by AfterFunc
+	OpTicker    = "ticker"    // a ticker was created, by NewTicker or Tick
+	OpFire      = "fire"      // a timer, ticker or sleep fired
+	OpStop      = "stop"      // a timer or ticker was stopped; OK is the result
+	OpReset     = "reset"     // a timer or ticker was reset; OK is the result for timers
+)
+
+// Entry is a recorded interaction with a clock. All entries have a clock time T,
+// which is the time when the interaction took place. Entries related to timers,
+// tickers and sleeps have the ID of the event they refer to, assigned in creation
+// order, and the ones that set a duration also have that duration as D.
+type Entry struct {
+	Op string        `json:"op"`
+	T  time.Time     `json:"t"`
+	ID int           `json:"id,omitempty"`
+	D  time.Duration `json:"d,omitempty"`
+	OK bool          `json:"ok,omitempty"`
+}
+
+// Replay is a clock that replays a recorded interaction.
+type Replay interface {
+	clocks.Clock
+
+	// Next moves the clock to the next recorded firing of a timer, ticker or
+	// sleep, once the replayed program has created it, and reports whether there
+	// was one.
+	Next() bool
+	// Run moves the clock through all the remaining recorded firings.
+	Run()
+	// Err returns the first divergence between the recording and the calls made
+	// on the replay clock, if any.
+	Err() error
+}
+
+// NewReplay reads the recording of a clock interaction from r, and returns a
+// clock that replays it. Now returns the recorded times, in order; creating a
+// timer, ticker or sleep, as well as calling Add or Set, moves the clock to the
+// recorded time of that call; Next and Run move it to the recorded firing times,
+// waiting for the replayed program to create each timer, ticker or sleep first.
+// Once the recording is exhausted, the replay clock behaves like a manual clock.
+func NewReplay(r io.Reader) (Replay, error) {
+	rc := &replay{clock: manualclock.New()}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("replayclock: line %d: %v", line, err)
+		}
+		switch e.Op {
+		case OpNow:
+			rc.nows = append(rc.nows, e)
+		case OpAdd, OpSet, OpSleep, OpTimer, OpAfterFunc, OpTicker:
+			rc.calls = append(rc.calls, e)
+		case OpFire:
+			rc.fires = append(rc.fires, e)
+		case OpStop, OpReset:
+			// the outcome of these only depends on the replayed program
+		default:
+			return nil, fmt.Errorf("replayclock: line %d: unknown operation %q", line, e.Op)
+		}
+		if line == 1 {
+			rc.clock.Set(e.T)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// createTimeout is how long, in real time, Next waits for the replayed program to
+// create the timer, ticker or sleep that fires next.
+const createTimeout = 10 * time.Second
+
+// replay represents a manual clock moved according to a recording.
+type replay struct {
+	clock   clocks.Clock  // manual clock actually providing the features
+	nows    []Entry       // recorded Now calls, not yet replayed
+	calls   []Entry       // recorded calls other than Now, not yet replayed
+	fires   []Entry       // recorded firings, not yet replayed
+	created int           // number of timers, tickers and sleeps created so far
+	changed chan struct{} // closed when `created` changes, if not nil
+	err     error         // first divergence from the recording
+	mu      sync.Mutex    // protection for all the above, except `clock`
+}
+
+// replay moves the clock to the recorded time of the next call, which should be
+// the provided operation.
+func (rc *replay) replay(op string, d time.Duration) {
+	if e, ok := rc.call(op, d); ok {
+		rc.moveTo(e.T)
+	}
+}
+
+// call returns the next recorded call, which should be the provided operation,
+// and reports whether there was one.
+func (rc *replay) call(op string, d time.Duration) (Entry, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.calls) == 0 {
+		rc.diverge(fmt.Errorf("replayclock: unexpected %s(%s) after the end of the recording", op, d))
+		return Entry{}, false
+	}
+	e := rc.calls[0]
+	rc.calls = rc.calls[1:]
+	if e.Op != op || e.D != d {
+		rc.diverge(fmt.Errorf("replayclock: unexpected %s(%s), recorded %s(%s)", op, d, e.Op, e.D))
+	}
+	return e, true
+}
+
+// create counts a timer, ticker or sleep created on the clock, waking up Next.
+func (rc *replay) create() {
+	rc.mu.Lock()
+	rc.created++
+	if rc.changed != nil {
+		close(rc.changed)
+		rc.changed = nil
+	}
+	rc.mu.Unlock()
+}
+
+// await waits until the timer, ticker or sleep with the provided id was created,
+// recording a divergence if it is not within createTimeout. The caller must hold
+// the lock, which is released while waiting.
+func (rc *replay) await(id int) {
+	if rc.created >= id {
+		return
+	}
+	expired := time.NewTimer(createTimeout)
+	defer expired.Stop()
+	for rc.created < id {
+		if rc.changed == nil {
+			rc.changed = make(chan struct{})
+		}
+		changed := rc.changed
+		rc.mu.Unlock()
+		select {
+		case <-changed:
+			rc.mu.Lock()
+		case <-expired.C:
+			rc.mu.Lock()
+			rc.diverge(fmt.Errorf("replayclock: event %d was not created within %s", id, createTimeout))
+			return
+		}
+	}
+}
+
+// diverge records err, unless a divergence was already recorded.
+// The caller must hold the lock.
+func (rc *replay) diverge(err error) {
+	if rc.err == nil {
+		rc.err = err
+	}
+}
+
+// moveTo moves the clock forward to t. It does nothing if t is not in the future,
+// so that it is safe to call from functions run by the clock itself.
+func (rc *replay) moveTo(t time.Time) {
+	if t.After(rc.clock.Now()) {
+		rc.clock.Set(t)
+	}
+}
+
+// Add moves the clock to the recorded time of the corresponding Add call.
+func (rc *replay) Add(d time.Duration) {
+	rc.replay(OpAdd, d)
+}
+
+// Set moves the clock to the recorded time of the corresponding Set call, which
+// should be t.
+func (rc *replay) Set(t time.Time) {
+	e, ok := rc.call(OpSet, 0)
+	if !ok {
+		return
+	}
+	if !e.T.Equal(t) {
+		rc.mu.Lock()
+		rc.diverge(fmt.Errorf("replayclock: unexpected set(%s), recorded set(%s)", t.Format(time.RFC3339Nano), e.T.Format(time.RFC3339Nano)))
+		rc.mu.Unlock()
+	}
+	rc.moveTo(e.T)
+}
+
+// Now returns the next recorded time, or the clock time once all recorded Now
+// calls have been replayed.
+func (rc *replay) Now() time.Time {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.nows) == 0 {
+		return rc.clock.Now()
+	}
+	e := rc.nows[0]
+	rc.nows = rc.nows[1:]
+	return e.T
+}
+
+// Since returns the time elapsed since t, based on the next recorded Now call.
+// Recorded times carry no monotonic clock reading, so the result depends on the
+// wall time.
+func (rc *replay) Since(t time.Time) time.Duration {
+	return rc.Now().Sub(t)
+}
+
+// Until returns the duration until t, based on the next recorded Now call.
+func (rc *replay) Until(t time.Time) time.Duration {
+	return t.Sub(rc.Now())
+}
+
+// Sleep pauses the current goroutine until the clock is moved past the duration.
+func (rc *replay) Sleep(d time.Duration) {
+	rc.replay(OpSleep, d)
+	if d <= 0 {
+		rc.create()
+		return
+	}
+	// a timer, rather than Sleep, so that it is counted once created
+	t := rc.clock.NewTimer(d)
+	rc.create()
+	<-t.C()
+}
+
+// After waits for the duration to elapse on the clock and then sends the current
+// time on the returned channel.
+func (rc *replay) After(d time.Duration) <-chan time.Time {
+	return rc.NewTimer(d).C()
+}
+
+// AfterFunc waits for the duration to elapse on the clock and then executes a function.
+func (rc *replay) AfterFunc(d time.Duration, f func()) clocks.Timer {
+	rc.replay(OpAfterFunc, d)
+	defer rc.create()
+	return rc.clock.AfterFunc(d, f)
+}
+
+// NewTimer returns a new Timer, controlled by the clock.
+func (rc *replay) NewTimer(d time.Duration) clocks.Timer {
+	rc.replay(OpTimer, d)
+	defer rc.create()
+	return rc.clock.NewTimer(d)
+}
+
+// Tick is a convenience wrapper for NewTicker providing access to the ticking
+// channel only. It returns nil if d <= 0.
+func (rc *replay) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return rc.NewTicker(d).C()
+}
+
+// NewTicker returns a new Ticker, controlled by the clock.
+func (rc *replay) NewTicker(d time.Duration) clocks.Ticker {
+	rc.replay(OpTicker, d)
+	defer rc.create()
+	return rc.clock.NewTicker(d)
+}
+
+// Next moves the clock to the next recorded firing of a timer, ticker or sleep,
+// once the replayed program has created it, and reports whether there was one.
+func (rc *replay) Next() bool {
+	rc.mu.Lock()
+	if len(rc.fires) == 0 {
+		rc.mu.Unlock()
+		return false
+	}
+	e := rc.fires[0]
+	rc.fires = rc.fires[1:]
+	rc.await(e.ID)
+	rc.mu.Unlock()
+	rc.moveTo(e.T)
+	return true
+}
+
+// Run moves the clock through all the remaining recorded firings.
+func (rc *replay) Run() {
+	for rc.Next() {
+	}
+}
+
+// Err returns the first divergence between the recording and the calls made on
+// the replay clock, if any.
+func (rc *replay) Err() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.err
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replayclock
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agext/clocks"
+	"github.com/agext/clocks/manualclock"
+)
+
+// program interacts with the provided clock, reporting all the times it sees.
+func program(clock clocks.Clock, out chan<- time.Time) {
+	out <- clock.Now()
+	clock.Sleep(time.Second)
+	out <- clock.Now()
+	timer := clock.NewTimer(2 * time.Second)
+	out <- <-timer.C()
+	timer.Stop()
+	ticker := clock.NewTicker(time.Second)
+	out <- <-ticker.C()
+	out <- <-ticker.C()
+	ticker.Stop()
+	out <- clock.Now()
+	close(out)
+}
+
+func Test_RecordReplay(t *testing.T) {
+	mc := manualclock.New()
+	var buf bytes.Buffer
+	rec := NewRecorder(mc, &buf)
+
+	recorded := make(chan time.Time, 10)
+	go program(rec, recorded)
+	exp := []time.Time{<-recorded}
+	mc.BlockUntil(1, time.Second)
+	mc.Add(10 * time.Second)
+	for rt := range recorded {
+		exp = append(exp, rt)
+	}
+	if err := rec.Err(); err != nil {
+		t.Fatalf(`unexpected recording error: %v`, err)
+	}
+
+	rp, err := NewReplay(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf(`unexpected replay error: %v`, err)
+	}
+	replayed := make(chan time.Time, 10)
+	go program(rp, replayed)
+	act := []time.Time{<-replayed}
+	rp.Run()
+	for rt := range replayed {
+		act = append(act, rt)
+	}
+	if err := rp.Err(); err != nil {
+		t.Errorf(`unexpected divergence: %v`, err)
+	}
+
+	if len(act) != len(exp) {
+		t.Fatalf(`unexpected number of times replayed: want %d got %d`, len(exp), len(act))
+	}
+	for i := range exp {
+		if !act[i].Equal(exp[i]) {
+			t.Errorf(`time #%d is incorrect: want %s got %s`, i, exp[i], act[i])
+		}
+	}
+
+	if rp.Next() {
+		t.Error(`Next() should return false at the end of the recording`)
+	}
+	rp.NewTimer(time.Second)
+	if rp.Err() == nil {
+		t.Error(`a call beyond the end of the recording should be reported as a divergence`)
+	}
+}
+
+func Test_NewReplay(t *testing.T) {
+	if _, err := NewReplay(strings.NewReader(`{"op":"now","t":"2000-01-01T00:00:00Z"}` + "\n" + `{"op":"bogus"}`)); err == nil {
+		t.Error(`an unknown operation should be reported`)
+	}
+	if _, err := NewReplay(strings.NewReader(`not json`)); err == nil {
+		t.Error(`a malformed line should be reported`)
+	}
+}
+
+func Test_ReplaySet(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	rp, err := NewReplay(strings.NewReader(`{"op":"set","t":"2000-01-01T00:00:00Z"}` + "\n" + `{"op":"set","t":"2000-01-01T01:00:00Z"}`))
+	if err != nil {
+		t.Fatalf(`unexpected replay error: %v`, err)
+	}
+
+	rp.Set(start)
+	if err := rp.Err(); err != nil {
+		t.Errorf(`unexpected divergence: %v`, err)
+	}
+	rp.Set(start.Add(2 * time.Hour))
+	if rp.Err() == nil {
+		t.Error(`a Set to another time than recorded should be reported as a divergence`)
+	}
+	if now := rp.Now(); !now.Equal(start.Add(time.Hour)) {
+		t.Errorf(`Set() did not move the clock to the recorded time: want %s got %s`, start.Add(time.Hour), now)
+	}
+}
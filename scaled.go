@@ -0,0 +1,301 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clocks
+
+import (
+	"sync"
+	"time"
+
+	"github.com/agext/clocks/internal/chantimer"
+)
+
+// ScaledClock is a live Clock that runs faster or slower than real time.
+type ScaledClock interface {
+	Clock
+
+	// Factor returns the current speed of the clock, relative to real time.
+	Factor() float64
+	// SetFactor changes the speed of the clock, relative to real time. Pending
+	// timers and tickers are rescheduled to respect the new speed.
+	SetFactor(f float64)
+}
+
+// NewScaled returns a live Clock that starts at epoch and advances factor times
+// faster than real time, e.g. with a factor of 60 a one-minute ticker fires every
+// second. A factor between 0 and 1 makes the clock run slower than real time.
+// It panics if factor is not positive.
+func NewScaled(epoch time.Time, factor float64) ScaledClock {
+	if factor <= 0 {
+		panic("clocks: non-positive factor for NewScaled")
+	}
+	return &scaledClock{
+		epoch:  epoch,
+		start:  time.Now(),
+		factor: factor,
+		events: map[*scaledEvent]struct{}{},
+	}
+}
+
+// scaledClock represents a clock that advances at a multiple of the real time speed.
+type scaledClock struct {
+	epoch  time.Time                 // clock time at `start`
+	start  time.Time                 // real time when the current factor was set
+	factor float64                   // clock speed relative to real time
+	events map[*scaledEvent]struct{} // pending timers and tickers
+	mu     sync.RWMutex              // protection for all the above
+}
+
+// Add is no-op on a scaled clock.
+func (*scaledClock) Add(d time.Duration) {}
+
+// Set is no-op on a scaled clock.
+func (*scaledClock) Set(t time.Time) {}
+
+// Now returns the current time on the scaled clock.
+func (sc *scaledClock) Now() time.Time {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.now()
+}
+
+// Since returns the time elapsed on the scaled clock since t.
+func (sc *scaledClock) Since(t time.Time) time.Duration {
+	return sc.Now().Sub(t)
+}
+
+// Until returns the duration until t on the scaled clock.
+func (sc *scaledClock) Until(t time.Time) time.Duration {
+	return t.Sub(sc.Now())
+}
+
+// now returns the current time on the scaled clock. The caller must hold a lock.
+func (sc *scaledClock) now() time.Time {
+	return sc.epoch.Add(time.Duration(float64(time.Since(sc.start)) * sc.factor))
+}
+
+// toReal converts a duration on the scaled clock to real time.
+// The caller must hold a lock.
+func (sc *scaledClock) toReal(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / sc.factor)
+}
+
+// Factor returns the current speed of the clock, relative to real time.
+func (sc *scaledClock) Factor() float64 {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.factor
+}
+
+// SetFactor changes the speed of the clock, relative to real time. Pending
+// timers and tickers are rescheduled to respect the new speed.
+// It panics if f is not positive.
+func (sc *scaledClock) SetFactor(f float64) {
+	if f <= 0 {
+		panic("clocks: non-positive factor for SetFactor")
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.epoch = sc.now()
+	sc.start = time.Now()
+	sc.factor = f
+	for e := range sc.events {
+		e.schedule()
+	}
+}
+
+// Sleep pauses the current goroutine for the given duration on the scaled clock.
+func (sc *scaledClock) Sleep(d time.Duration) {
+	<-sc.After(d)
+}
+
+// After waits for the duration to elapse on the scaled clock and then sends the
+// current time on the returned channel.
+func (sc *scaledClock) After(d time.Duration) <-chan time.Time {
+	return sc.NewTimer(d).C()
+}
+
+// AfterFunc waits for the duration to elapse on the scaled clock and then calls
+// f in its own goroutine. A Timer is returned that can be stopped.
+func (sc *scaledClock) AfterFunc(d time.Duration, f func()) Timer {
+	return sc.newEvent(d, 0, f)
+}
+
+// NewTimer returns a new Timer that fires after the duration elapses on the scaled clock.
+func (sc *scaledClock) NewTimer(d time.Duration) Timer {
+	return sc.newEvent(d, 0, nil)
+}
+
+// Tick is a convenience wrapper for NewTicker providing access to the ticking
+// channel only. It returns nil if d <= 0.
+func (sc *scaledClock) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return sc.NewTicker(d).C()
+}
+
+// NewTicker returns a new Ticker that ticks with a period of d on the scaled clock.
+// It panics if d <= 0.
+func (sc *scaledClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clocks: non-positive interval for NewTicker")
+	}
+	return (*scaledTicker)(sc.newEvent(d, d, nil))
+}
+
+// newEvent creates and schedules a timer or ticker on the scaled clock.
+func (sc *scaledClock) newEvent(d, period time.Duration, f func()) *scaledEvent {
+	e := &scaledEvent{
+		clock:  sc,
+		period: period,
+		fn:     f,
+	}
+	if f == nil {
+		e.c = make(chan time.Time, 1)
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e.next = sc.now().Add(d)
+	sc.events[e] = struct{}{}
+	e.schedule()
+	return e
+}
+
+// scaledEvent is a timer or ticker on a scaled clock. It is backed by a real
+// timer that is rescheduled whenever the speed of the clock changes.
+// All fields except `c` and `fn` are protected by the clock's mutex.
+type scaledEvent struct {
+	c      chan time.Time
+	clock  *scaledClock  // the clock that controls this event
+	next   time.Time     // next event time, on the scaled clock
+	period time.Duration // (tickers only) time between ticks, on the scaled clock
+	fn     func()        // (timers only) AfterFunc function
+	timer  *time.Timer   // real timer for the next event
+	gen    int           // incremented when the real timer is replaced
+}
+
+// schedule (re)starts the real timer for the next event. The caller must hold
+// the clock's lock.
+func (e *scaledEvent) schedule() {
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.gen++
+	gen := e.gen
+	e.timer = time.AfterFunc(e.clock.toReal(e.next.Sub(e.clock.now())), func() { e.fire(gen) })
+}
+
+// fire plays the event, unless its real timer was replaced in the meantime.
+func (e *scaledEvent) fire(gen int) {
+	sc := e.clock
+	sc.mu.Lock()
+	if gen != e.gen {
+		sc.mu.Unlock()
+		return
+	}
+	now := sc.now()
+	if e.period != 0 {
+		e.next = e.next.Add(e.period)
+		if e.next.Before(now) {
+			// drop the ticks missed by a slow goroutine scheduler, like time.Ticker
+			e.next = now.Add(e.period - now.Sub(e.next)%e.period)
+		}
+		e.schedule()
+	} else {
+		delete(sc.events, e)
+		e.timer = nil
+	}
+	if e.fn == nil {
+		// sent while holding the lock, so that Stop and Reset can drain it
+		select {
+		case e.c <- now:
+		default:
+		}
+	}
+	sc.mu.Unlock()
+
+	if e.fn != nil {
+		e.fn()
+	}
+}
+
+// stop removes the event from the clock, reporting whether it was pending or its
+// value was not received yet.
+func (e *scaledEvent) stop() bool {
+	sc := e.clock
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	drained := chantimer.Drain(e.c)
+	if _, active := sc.events[e]; !active {
+		return drained
+	}
+	delete(sc.events, e)
+	e.timer.Stop()
+	e.timer = nil
+	e.gen++
+	return true
+}
+
+// C returns the timer-expiry channel
+func (e *scaledEvent) C() <-chan time.Time {
+	return e.c
+}
+
+// Stop turns off the timer.
+func (e *scaledEvent) Stop() bool {
+	return e.stop()
+}
+
+// Reset changes the expiry time of the timer, and reactivates it if it was stopped.
+func (e *scaledEvent) Reset(d time.Duration) bool {
+	sc := e.clock
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	_, active := sc.events[e]
+	active = chantimer.Drain(e.c) || active
+	e.next = sc.now().Add(d)
+	sc.events[e] = struct{}{}
+	e.schedule()
+	return active
+}
+
+// scaledTicker is a ticker on a scaled clock.
+type scaledTicker scaledEvent
+
+// C returns the tick channel
+func (t *scaledTicker) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop turns off the ticker.
+func (t *scaledTicker) Stop() {
+	(*scaledEvent)(t).stop()
+}
+
+// Reset stops the ticker and resets its period to the specified duration, on the
+// scaled clock, then reactivates it. It panics if d <= 0.
+func (t *scaledTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("clocks: non-positive interval for Ticker.Reset")
+	}
+	sc := t.clock
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	t.period = d
+	chantimer.Drain(t.c)
+	t.next = sc.now().Add(d)
+	sc.events[(*scaledEvent)(t)] = struct{}{}
+	(*scaledEvent)(t).schedule()
+}
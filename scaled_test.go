@@ -0,0 +1,135 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clocks
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_NewScaled(t *testing.T) {
+	epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	start := time.Now()
+	clock := NewScaled(epoch, 3600)
+
+	time.Sleep(10 * time.Millisecond)
+	elapsed := clock.Now().Sub(epoch)
+	if max := 3600 * time.Since(start); elapsed < 3600*10*time.Millisecond || elapsed > max {
+		t.Errorf(`Now() is incorrect: want between %s and %s after epoch, got %s`, 3600*10*time.Millisecond, max, elapsed)
+	}
+
+	timeout := map[string]<-chan time.Time{
+		"Sleep": func() <-chan time.Time {
+			ch := make(chan time.Time, 1)
+			go func() {
+				clock.Sleep(time.Minute)
+				ch <- clock.Now()
+			}()
+			return ch
+		}(),
+		"After": clock.After(time.Minute),
+		"AfterFunc": func() <-chan time.Time {
+			ch := make(chan time.Time, 1)
+			clock.AfterFunc(time.Minute, func() { ch <- clock.Now() })
+			return ch
+		}(),
+		"NewTimer": func() <-chan time.Time {
+			ch := make(chan time.Time, 1)
+			go func() {
+				nt := clock.NewTimer(time.Hour)
+				nt.Reset(time.Minute)
+				<-nt.C()
+				ch <- clock.Now()
+				nt.Stop()
+			}()
+			return ch
+		}(),
+		"Tick": clock.Tick(time.Minute),
+		"NewTicker": func() <-chan time.Time {
+			ch := make(chan time.Time, 1)
+			go func() {
+				nt := clock.NewTicker(time.Minute)
+				<-nt.C()
+				<-nt.C()
+				ch <- clock.Now()
+				nt.Stop()
+			}()
+			return ch
+		}(),
+		"TickerReset": func() <-chan time.Time {
+			ch := make(chan time.Time, 1)
+			go func() {
+				nt := clock.NewTicker(time.Hour)
+				nt.Reset(time.Minute)
+				<-nt.C()
+				<-nt.C()
+				ch <- clock.Now()
+				nt.Stop()
+			}()
+			return ch
+		}(),
+	}
+
+	for fn := range timeout {
+		select {
+		case <-timeout[fn]:
+		case <-time.After(time.Second):
+			t.Error(`NewScaled().` + fn + `() is taking too long - the clock may not be scaled`)
+		}
+	}
+
+	timer := clock.NewTimer(time.Hour)
+	if !timer.Stop() {
+		t.Error(`Stop() on a pending timer should return true`)
+	}
+	if timer.Stop() {
+		t.Error(`Stop() on a stopped timer should return false`)
+	}
+	if timer.Reset(time.Hour) {
+		t.Error(`Reset() on a stopped timer should return false`)
+	}
+	if !timer.Reset(time.Hour) {
+		t.Error(`Reset() on a pending timer should return true`)
+	}
+	timer.Stop()
+}
+
+func Test_ScaledClock_SetFactor(t *testing.T) {
+	clock := NewScaled(time.Now(), 1)
+	if f := clock.Factor(); f != 1 {
+		t.Errorf(`Factor() is incorrect: want %v got %v`, 1.0, f)
+	}
+
+	timer := clock.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	clock.SetFactor(3600 * 1000)
+	if f := clock.Factor(); f != 3600*1000 {
+		t.Errorf(`Factor() is incorrect: want %v got %v`, 3600*1000.0, f)
+	}
+
+	select {
+	case <-timer.C():
+	case <-time.After(100 * time.Millisecond):
+		t.Error(`pending timer was not rescheduled after SetFactor()`)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error(`SetFactor() should panic on a non-positive factor`)
+		}
+	}()
+	clock.SetFactor(0)
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 ALRUX Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.25
+
+package clocks
+
+import (
+	"context"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func Test_Synctest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		clock := New()
+		start := clock.Now()
+
+		timer := clock.NewTimer(time.Hour)
+		clock.Sleep(time.Hour)
+		select {
+		case <-timer.C():
+		default:
+			t.Error(`timer did not fire on the fake time of the bubble`)
+		}
+		if d := clock.Since(start); d != time.Hour {
+			t.Errorf(`Since() is incorrect in a bubble: want %s got %s`, time.Hour, d)
+		}
+
+		ctx, cancel := WithTimeout(context.Background(), clock, time.Minute)
+		defer cancel()
+		<-ctx.Done()
+		if d := clock.Since(start); d != time.Hour+time.Minute {
+			t.Errorf(`context expired at the wrong time: want %s got %s`, time.Hour+time.Minute, d)
+		}
+
+		scaled := NewScaled(start, 60)
+		scaled.Sleep(time.Hour)
+		if d := clock.Since(start); d != time.Hour+2*time.Minute {
+			t.Errorf(`scaled clock slept for the wrong time: want %s got %s`, time.Minute, d-time.Hour-time.Minute)
+		}
+	})
+}